@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/bits"
+	"os"
+	"strings"
+)
+
+// words phishing domains add to a brand, as in paypal-login or securepaypal
+var squatKeywords = map[string]bool{
+	"access": true, "account": true, "accounts": true, "alert": true, "app": true, "auth": true, "billing": true,
+	"center": true, "confirm": true, "customer": true, "help": true, "id": true, "login": true, "mail": true,
+	"my": true, "official": true, "online": true, "pay": true, "payment": true, "portal": true, "recovery": true,
+	"secure": true, "security": true, "service": true, "services": true, "signin": true, "support": true,
+	"team": true, "unlock": true, "update": true, "verify": true, "verification": true, "wallet": true, "web": true,
+}
+
+// lookalike characters, multi character swaps first, each mapped to the
+// letter it passes for
+var squatSwaps = strings.NewReplacer(
+	"rn", "m", "vv", "w", "cl", "d",
+	"0", "o", "1", "l", "i", "l", "3", "e", "4", "a", "5", "s", "7", "t", "8", "b",
+)
+
+// the keywords as they read after squatSwaps, to find them in a swapped name
+var canonicalKeywords = func() map[string]bool {
+	keywords := map[string]bool{}
+	for keyword := range squatKeywords {
+		keywords[squatSwaps.Replace(keyword)] = true
+	}
+	return keywords
+}()
+
+// brand is a protected domain, split into the label people recognise and
+// its public suffix
+type brand struct {
+	domain      string
+	registrable string
+	label       string
+	suffix      string
+	canonical   string
+}
+
+// brandList is the -brands file, and the least score reported
+type brandList struct {
+	brands    []brand
+	threshold float64
+}
+
+// squatMatch is the closest protected brand to a name and how it's imitated
+type squatMatch struct {
+	brand     string
+	technique string
+	score     float64
+}
+
+// Load protected domains, one per line. Blank lines and lines starting
+// with # are ignored.
+func loadBrands(path string, threshold float64) (*brandList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := &brandList{threshold: threshold}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		domain := normaliseDomain(line)
+		registrable := publicSuffixes.registrableDomain(domain)
+		if registrable == "" {
+			return nil, fmt.Errorf("%s:%d: %q has no registrable domain", path, lineNumber, line)
+		}
+
+		suffix := publicSuffixes.publicSuffix(registrable)
+		label := strings.TrimSuffix(registrable, "."+suffix)
+		list.brands = append(list.brands, brand{
+			domain:      domain,
+			registrable: registrable,
+			label:       label,
+			suffix:      suffix,
+			canonical:   squatSwaps.Replace(label),
+		})
+	}
+
+	return list, scanner.Err()
+}
+
+// The protected brand a certificate name most resembles, if it scores at
+// least the threshold. The brands' own domains never match.
+func (b *brandList) match(name string) (squatMatch, bool) {
+	name = normaliseDomain(name)
+	registrable := publicSuffixes.registrableDomain(name)
+	if registrable == "" {
+		return squatMatch{}, false
+	}
+
+	suffix := publicSuffixes.publicSuffix(registrable)
+	label := strings.TrimSuffix(registrable, "."+suffix)
+	canonical := squatSwaps.Replace(label)
+
+	var best squatMatch
+	for _, brand := range b.brands {
+		if registrable == brand.registrable {
+			continue
+		}
+
+		if technique, score := brand.compare(label, canonical, suffix); score > best.score {
+			best = squatMatch{brand: brand.domain, technique: technique, score: score}
+		}
+	}
+
+	return best, best.score > 0 && best.score >= b.threshold
+}
+
+// How a registrable label and suffix imitate the brand, and how closely,
+// from 0 for not at all to 1. canonical is the label after squatSwaps, worked
+// out once for every brand. The most specific technique is reported, with a
+// TLD swap noted alongside it.
+func (b brand) compare(label string, canonical string, suffix string) (string, float64) {
+	technique, score := b.compareLabel(label, canonical)
+	if score == 0 {
+		return "", 0
+	}
+
+	if suffix != b.suffix && technique != "tld swap" {
+		technique += ", tld swap"
+	}
+
+	return technique, score
+}
+
+func (b brand) compareLabel(label string, canonical string) (string, float64) {
+	// the same name under another suffix, paypal.net
+	if label == b.label {
+		return "tld swap", 0.95
+	}
+
+	// lookalike characters, paypa1 or rnicrosoft
+	if canonical == b.canonical {
+		return "character swap", 0.9
+	}
+
+	// split with hyphens, pay-pal
+	joined := strings.ReplaceAll(label, "-", "")
+	if joined == b.label {
+		return "hyphenation", 0.9
+	}
+	if squatSwaps.Replace(joined) == b.canonical {
+		return "hyphenation, character swap", 0.85
+	}
+
+	// one flipped bit, as a memory error would make, paypel
+	if isBitsquat(label, b.label) {
+		return "bitsquat", 1 - 1/float64(len(b.label))
+	}
+
+	// the brand with words around it, g00gle-login or paypalsecure
+	if technique, score := b.compareKeywords(label, canonical); score > 0 {
+		return technique, score
+	}
+
+	// typos, short brands excepted as everything is near them
+	if len(b.label) >= 5 {
+		distance := min(editDistance(label, b.label), editDistance(canonical, b.canonical))
+		if distance <= 2 {
+			return "edit distance", 1 - float64(distance)/float64(max(len(label), len(b.label)))
+		}
+	}
+
+	return "", 0
+}
+
+// The brand as one hyphenated part of the label with keywords or other
+// words, or run together with a keyword
+func (b brand) compareKeywords(label string, canonical string) (string, float64) {
+	technique, score := "", 0.0
+
+	if parts := strings.Split(label, "-"); len(parts) > 1 {
+		found, swapped, keywords := false, false, true
+		for _, part := range parts {
+			switch {
+			case part == b.label:
+				found = true
+			case squatSwaps.Replace(part) == b.canonical:
+				found, swapped = true, true
+			case !squatKeywords[part]:
+				keywords = false
+			}
+		}
+
+		if !found {
+			return "", 0
+		}
+
+		technique, score = "hyphenation", 0.75
+		if keywords {
+			technique, score = "keyword", 0.85
+		}
+		if swapped {
+			technique, score = technique+", character swap", score*0.95
+		}
+
+		return technique, score
+	}
+
+	for _, rest := range []string{strings.TrimPrefix(canonical, b.canonical), strings.TrimSuffix(canonical, b.canonical)} {
+		if rest != canonical && canonicalKeywords[rest] {
+			technique, score = "keyword", 0.8
+			if !strings.Contains(label, b.label) {
+				technique, score = "keyword, character swap", 0.8*0.95
+			}
+		}
+	}
+
+	return technique, score
+}
+
+// Whether two names of the same length differ by a single bit, leaving a
+// character that's valid in a hostname
+func isBitsquat(label string, brand string) bool {
+	if len(label) != len(brand) {
+		return false
+	}
+
+	differ := -1
+	for i := 0; i < len(label); i++ {
+		if label[i] != brand[i] {
+			if differ >= 0 {
+				return false
+			}
+			differ = i
+		}
+	}
+
+	if differ < 0 || bits.OnesCount8(label[differ]^brand[differ]) != 1 {
+		return false
+	}
+
+	c := label[differ]
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-'
+}
+
+// Optimal string alignment distance, edits counting an adjacent swap as one
+func editDistance(a string, b string) int {
+	previous2 := make([]int, len(b)+1)
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				current[j] = min(current[j], previous2[j-2]+1)
+			}
+		}
+
+		previous2, previous, current = previous, current, previous2
+	}
+
+	return previous[len(b)]
+}
+
+// The lookalike column, blank unless matched by -brands
+func squatColumn(cert certDetails) string {
+	if cert.squatBrand == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s (%s, %.2f)", cert.squatBrand, cert.squatTechnique, cert.squatScore)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A brand as loadBrands would make it
+func testBrand(label string, suffix string) brand {
+	return brand{
+		domain:      label + "." + suffix,
+		registrable: label + "." + suffix,
+		label:       label,
+		suffix:      suffix,
+		canonical:   squatSwaps.Replace(label),
+	}
+}
+
+func TestCompareLabel(t *testing.T) {
+	paypal := testBrand("paypal", "com")
+	microsoft := testBrand("microsoft", "com")
+	google := testBrand("google", "com")
+	ebay := testBrand("ebay", "com")
+
+	tests := []struct {
+		brand     brand
+		label     string
+		technique string
+		score     float64
+	}{
+		{paypal, "paypal", "tld swap", 0.95},
+		{paypal, "paypa1", "character swap", 0.9},
+		{microsoft, "rnicrosoft", "character swap", 0.9},
+		{paypal, "pay-pal", "hyphenation", 0.9},
+		{paypal, "pay-pa1", "hyphenation, character swap", 0.85},
+
+		// one bit, scored by the length of the brand
+		{paypal, "paypel", "bitsquat", 1 - 1.0/6},
+		{microsoft, "microsnft", "bitsquat", 1 - 1.0/9},
+
+		{paypal, "paypal-login", "keyword", 0.85},
+		{paypal, "secure-paypal-login", "keyword", 0.85},
+		{google, "g00gle-login", "keyword, character swap", 0.85 * 0.95},
+		{paypal, "paypal-fancy", "hyphenation", 0.75},
+		{paypal, "paypa1-fancy", "hyphenation, character swap", 0.75 * 0.95},
+		{paypal, "paypalsecure", "keyword", 0.8},
+		{paypal, "securepaypa1", "keyword, character swap", 0.8 * 0.95},
+
+		{paypal, "paypall", "edit distance", 1 - 1.0/7},
+		{paypal, "pyapal", "edit distance", 1 - 1.0/6},
+		{paypal, "paxpxl", "edit distance", 1 - 2.0/6},
+		{microsoft, "rnicrosotf", "edit distance", 1 - 1.0/10},
+
+		// too far, or a brand too short for typos
+		{paypal, "pxxpxl", "", 0},
+		{paypal, "example", "", 0},
+		{paypal, "fancy-words", "", 0},
+		{paypal, "paypalfancy", "", 0},
+		{ebay, "ebya", "", 0},
+	}
+
+	for _, test := range tests {
+		technique, score := test.brand.compareLabel(test.label, squatSwaps.Replace(test.label))
+		if technique != test.technique || math.Abs(score-test.score) > 1e-9 {
+			t.Errorf("%s compareLabel(%q) = %q, %.4f, want %q, %.4f", test.brand.label, test.label, technique, score, test.technique, test.score)
+		}
+	}
+}
+
+func TestCompareTLDSwap(t *testing.T) {
+	paypal := testBrand("paypal", "com")
+
+	tests := []struct {
+		label     string
+		suffix    string
+		technique string
+	}{
+		{"paypal", "net", "tld swap"},
+		{"paypa1", "net", "character swap, tld swap"},
+		{"paypa1", "com", "character swap"},
+		{"example", "net", ""},
+	}
+
+	for _, test := range tests {
+		if technique, _ := paypal.compare(test.label, squatSwaps.Replace(test.label), test.suffix); technique != test.technique {
+			t.Errorf("compare(%q, %q) = %q, want %q", test.label, test.suffix, technique, test.technique)
+		}
+	}
+}
+
+func TestIsBitsquat(t *testing.T) {
+	tests := []struct {
+		label string
+		brand string
+		want  bool
+	}{
+		{"paypel", "paypal", true},
+		{"paypam", "paypal", true},
+		{"q1", "qq", true},
+		{"paypal", "paypal", false},
+		{"paypa", "paypal", false},
+		{"pbypbl", "paypal", false},
+		{"paypax", "paypal", false},
+		{"paypaL", "paypal", false},
+		{"paypa,", "paypal", false},
+	}
+
+	for _, test := range tests {
+		if got := isBitsquat(test.label, test.brand); got != test.want {
+			t.Errorf("isBitsquat(%q, %q) = %v, want %v", test.label, test.brand, got, test.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "ab", 2},
+		{"paypal", "paypal", 0},
+		{"paypal", "pyapal", 1},
+		{"paypal", "paypall", 1},
+		{"kitten", "sitting", 3},
+		{"ca", "abc", 3},
+	}
+
+	for _, test := range tests {
+		if got := editDistance(test.a, test.b); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := editDistance(test.b, test.a); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.b, test.a, got, test.want)
+		}
+	}
+}
+
+func TestBrandListMatch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "brands.txt")
+	if err := os.WriteFile(file, []byte("# protected\npaypal.com\n\nwww.google.co.uk\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	brands, err := loadBrands(file, 0.85)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		brand string
+		score float64
+		found bool
+	}{
+		{"paypa1.com", "paypal.com", 0.9, true},
+		{"*.paypal.net", "paypal.com", 0.95, true},
+		{"login.g00gle.com", "www.google.co.uk", 0.9, true},
+
+		// at the threshold, and below it with the closest brand still given
+		{"paypal-login.com", "paypal.com", 0.85, true},
+		{"paypal-fancy.com", "paypal.com", 0.75, false},
+
+		// the brands' own domains, and names like nothing
+		{"www.paypal.com", "", 0, false},
+		{"mail.google.co.uk", "", 0, false},
+		{"example.com", "", 0, false},
+		{"co.uk", "", 0, false},
+	}
+
+	for _, test := range tests {
+		match, found := brands.match(test.name)
+		if match.brand != test.brand || math.Abs(match.score-test.score) > 1e-9 || found != test.found {
+			t.Errorf("match(%q) = %q, %.4f, %v, want %q, %.4f, %v", test.name, match.brand, match.score, found, test.brand, test.score, test.found)
+		}
+	}
+}
+
+func TestLoadBrandsRejectsSuffix(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "brands.txt")
+	if err := os.WriteFile(file, []byte("paypal.com\nco.uk\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadBrands(file, 0.8); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("loadBrands = %v, want an error on line 2", err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the critical extension that marks a precertificate, RFC 6962 section 3.1
+var oidPrecertPoison = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+
+// Take a message, decode and parse leaf_cert.as_der.
+// The precert poison extension is recognised rather than left unhandled.
+func parseLeafDER(message *certstreamMessage) (*x509.Certificate, error) {
+	leaf, err := message.leaf()
+	if err != nil {
+		return nil, err
+	}
+
+	if leaf.AsDER == "" {
+		return nil, &fieldError{"data.leaf_cert.as_der", "is missing"}
+	}
+
+	der, err := base64.StdEncoding.DecodeString(leaf.AsDER)
+	if err != nil {
+		return nil, &fieldError{"data.leaf_cert.as_der", fmt.Sprintf("is not base64: %v", err)}
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	unhandled := cert.UnhandledCriticalExtensions[:0]
+	for _, oid := range cert.UnhandledCriticalExtensions {
+		if !oid.Equal(oidPrecertPoison) {
+			unhandled = append(unhandled, oid)
+		}
+	}
+	cert.UnhandledCriticalExtensions = unhandled
+
+	return cert, nil
+}
+
+// Check whether a parsed certificate carries the precert poison
+func isPrecert(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidPrecertPoison) {
+			return true
+		}
+	}
+	return false
+}
+
+// Every DNS name on a parsed certificate, CN first, as all_domains lists them
+func domainsFromDER(cert *x509.Certificate) []string {
+	var domains []string
+	seen := map[string]bool{}
+
+	for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			domains = append(domains, name)
+		}
+	}
+
+	return domains
+}
+
+// Describe the public key, e.g. "RSA 2048" or "ECDSA 256"
+func keyDescription(cert *x509.Certificate) (string, int) {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	}
+
+	return cert.PublicKeyAlgorithm.String(), 0
+}
+
+// Overwrite the certstream rendered fields with those from the certificate
+// itself. When compare is set, note every field where the two disagree.
+func applyDERDetails(details *certDetails, cert *x509.Certificate, jsonPolicies string, compare bool) {
+	derDomains := domainsFromDER(cert)
+	derPolicies := renderPolicies(cert)
+
+	if compare {
+		details.derMismatch = compareDER(details, cert, derDomains, jsonPolicies, derPolicies)
+	}
+
+	details.commonName = cert.Subject.CommonName
+	details.aggregatedName = renderName(cert.Subject).Aggregated
+	details.allDomains = derDomains
+	details.fingerprint = sha1Fingerprint(cert.Raw)
+	setValidation(details, derPolicies)
+	details.keyAlgorithm, details.keySize = keyDescription(cert)
+	details.notBefore = cert.NotBefore
+	details.notAfter = cert.NotAfter
+	details.issuerName = cert.Issuer.String()
+	details.precert = isPrecert(cert)
+	details.serialNumber = fmt.Sprintf("%X", cert.SerialNumber)
+	details.fromDER = true
+}
+
+// List the fields where certstream's rendering disagrees with the DER
+func compareDER(details *certDetails, cert *x509.Certificate, derDomains []string, jsonPolicies string, derPolicies string) []string {
+	var mismatches []string
+
+	if details.commonName != cert.Subject.CommonName {
+		mismatches = append(mismatches, "CN")
+	}
+
+	if !sameStrings(details.allDomains, derDomains) {
+		mismatches = append(mismatches, "SANs")
+	}
+
+	if !sameStrings(policyOIDs(jsonPolicies), policyOIDs(derPolicies)) {
+		mismatches = append(mismatches, "policies")
+	}
+
+	if !strings.EqualFold(details.fingerprint, sha1Fingerprint(cert.Raw)) {
+		mismatches = append(mismatches, "fingerprint")
+	}
+
+	// certstream's issuer is the first chain entry, if it sent a chain
+	if details.issuingCA != "" || details.issuingOrg != "" {
+		org := ""
+		if len(cert.Issuer.Organization) > 0 {
+			org = cert.Issuer.Organization[0]
+		}
+		if details.issuingCA != cert.Issuer.CommonName || details.issuingOrg != org {
+			mismatches = append(mismatches, "issuer")
+		}
+	}
+
+	// certstream renders validity in whole seconds
+	if details.notBefore.Unix() != cert.NotBefore.Unix() {
+		mismatches = append(mismatches, "not_before")
+	}
+	if details.notAfter.Unix() != cert.NotAfter.Unix() {
+		mismatches = append(mismatches, "not_after")
+	}
+
+	return mismatches
+}
+
+// Pull the OIDs out of a rendered certificatePolicies blob
+func policyOIDs(policies string) []string {
+	var oids []string
+
+	for _, entry := range strings.Split(policies, "\n") {
+		if strings.HasPrefix(entry, "Policy: ") {
+			oids = append(oids, strings.TrimSpace(entry[8:]))
+		}
+	}
+
+	return oids
+}
+
+// Compare two lists ignoring order and case
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	sortedA := make([]string, len(a))
+	sortedB := make([]string, len(b))
+	for i := range a {
+		sortedA[i] = strings.ToLower(a[i])
+		sortedB[i] = strings.ToLower(b[i])
+	}
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Format a validity time for the table, blank if unknown
+func formatValidity(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02")
+}
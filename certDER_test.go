@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/x509"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompareDER(t *testing.T) {
+	ca := newTestCA(t)
+	leaf, err := x509.ParseCertificate(ca.issue(t, "coronavictus.com", 100, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(message *certstreamMessage)
+		want   []string
+	}{
+		{"agreeing", func(message *certstreamMessage) {}, nil},
+		{"CN", func(message *certstreamMessage) {
+			message.Data.LeafCert.Subject.CN = "coronavictus.net"
+		}, []string{"CN"}},
+		{"SANs", func(message *certstreamMessage) {
+			message.Data.LeafCert.AllDomains = append(message.Data.LeafCert.AllDomains, "extra.example.com")
+		}, []string{"SANs"}},
+		{"fingerprint", func(message *certstreamMessage) {
+			message.Data.LeafCert.Fingerprint = "00:11:22"
+		}, []string{"fingerprint"}},
+		{"issuer name", func(message *certstreamMessage) {
+			message.Data.Chain[0].Subject.CN = "Other Issuing CA"
+		}, []string{"issuer"}},
+		{"issuer organisation", func(message *certstreamMessage) {
+			message.Data.Chain[0].Subject.O = "Other CA Ltd"
+		}, []string{"issuer"}},
+		{"validity", func(message *certstreamMessage) {
+			message.Data.LeafCert.NotBefore -= 3600
+			message.Data.LeafCert.NotAfter += 86400
+		}, []string{"not_before", "not_after"}},
+		{"several", func(message *certstreamMessage) {
+			message.Data.LeafCert.Subject.CN = "coronavictus.net"
+			message.Data.Chain[0].Subject.CN = "Other Issuing CA"
+			message.Data.LeafCert.NotAfter++
+		}, []string{"CN", "issuer", "not_after"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := wrapCertificates("X509LogEntry", time.Now(), leaf, []*x509.Certificate{ca.cert}, 1, "", "test", "test")
+			test.tamper(message)
+
+			details, err := getCertDetails(message, leaf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(details.derMismatch, test.want) {
+				t.Errorf("derMismatch = %q, want %q", details.derMismatch, test.want)
+			}
+
+			// the certificate's own fields win
+			if details.commonName != "coronavictus.com" || !details.notAfter.Equal(leaf.NotAfter) || details.issuerName != ca.cert.Subject.String() {
+				t.Errorf("details %q until %s from %q, want the DER's", details.commonName, details.notAfter, details.issuerName)
+			}
+		})
+	}
+}
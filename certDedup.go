@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+)
+
+// certDedup maps fingerprints, and issuer plus serial, to rows of the
+// certificates table, so the same certificate from several logs, or its
+// precert, is merged into one row. Only the newest limit keys are kept.
+type certDedup struct {
+	rows  map[string]int
+	keys  []string
+	next  int
+	limit int
+}
+
+// count of matches merged into an earlier row
+var countDuplicates int
+
+func newCertDedup(limit int) *certDedup {
+	return &certDedup{rows: map[string]int{}, limit: limit}
+}
+
+// The keys a certificate is known by. A precert and its final certificate
+// have different fingerprints but share the issuer and serial.
+func dedupKeys(details certDetails) []string {
+	var keys []string
+
+	if details.fingerprint != "" {
+		keys = append(keys, "fingerprint:"+normaliseFingerprint(details.fingerprint))
+	}
+
+	issuer := normaliseFingerprint(details.issuerFingerprint)
+	if issuer == "" {
+		issuer = strings.ToLower(details.issuingCA)
+	}
+	if serial := normaliseSerial(details.serialNumber); serial != "" && issuer != "" {
+		keys = append(keys, "serial:"+issuer+"/"+serial)
+	}
+
+	return keys
+}
+
+// Upper case a hex serial and drop leading zeros and colons
+func normaliseSerial(serial string) string {
+	return strings.TrimLeft(strings.ToUpper(strings.ReplaceAll(serial, ":", "")), "0")
+}
+
+// The row already holding this certificate, if any
+func (d *certDedup) find(details certDetails) (int, bool) {
+	for _, key := range dedupKeys(details) {
+		if row, ok := d.rows[key]; ok {
+			return row, true
+		}
+	}
+
+	return 0, false
+}
+
+// Point each of the certificate's keys at a row, forgetting the oldest
+// keys once over the limit
+func (d *certDedup) add(details certDetails, row int) {
+	for _, key := range dedupKeys(details) {
+		if _, ok := d.rows[key]; ok {
+			d.rows[key] = row
+			continue
+		}
+
+		if len(d.keys) < d.limit {
+			d.keys = append(d.keys, key)
+		} else {
+			delete(d.rows, d.keys[d.next])
+			d.keys[d.next] = key
+			d.next = (d.next + 1) % d.limit
+		}
+		d.rows[key] = row
+	}
+}
+
+// Fold a duplicate into the row already in the table. The final
+// certificate's details replace its precert's, and the logs and entry
+// types from both are kept.
+func mergeDuplicate(existing certDetails, duplicate certDetails) certDetails {
+	merged := existing
+	if existing.precert && !duplicate.precert {
+		merged = duplicate
+		merged.matchedDomain = existing.matchedDomain
+		merged.matchedPattern = existing.matchedPattern
+		merged.publicSuffix = existing.publicSuffix
+		merged.registrable = existing.registrable
+		merged.precertFingerprint = existing.fingerprint
+		merged.squatBrand = existing.squatBrand
+		merged.squatTechnique = existing.squatTechnique
+		merged.squatScore = existing.squatScore
+	} else if duplicate.precert && !existing.precert {
+		merged.precertFingerprint = duplicate.fingerprint
+	}
+
+	// first seen by whichever arrived first
+	merged.seen = existing.seen
+
+	merged.logs = appendUnique(existing.logs, duplicate.logs...)
+	merged.seenAs = appendUnique(existing.seenAs, duplicate.seenAs...)
+
+	return merged
+}
+
+// Append the values not already in the list
+func appendUnique(list []string, values ...string) []string {
+	result := append([]string(nil), list...)
+
+	for _, value := range values {
+		found := false
+		for _, existing := range result {
+			if existing == value {
+				found = true
+				break
+			}
+		}
+
+		if !found && value != "" {
+			result = append(result, value)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDedupKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		details certDetails
+		want    []string
+	}{
+		{"fingerprint and serial", certDetails{fingerprint: "0f:29", serialNumber: "00:03:ab", issuerFingerprint: "e6:a3"}, []string{"fingerprint:0F29", "serial:E6A3/3AB"}},
+		{"issuer name fallback", certDetails{fingerprint: "0F:29", serialNumber: "3AB", issuingCA: "R3"}, []string{"fingerprint:0F29", "serial:r3/3AB"}},
+		{"no issuer", certDetails{fingerprint: "0F:29", serialNumber: "3AB"}, []string{"fingerprint:0F29"}},
+		{"zero serial", certDetails{serialNumber: "00", issuerFingerprint: "E6:A3"}, nil},
+		{"nothing", certDetails{}, nil},
+	}
+
+	for _, test := range tests {
+		if keys := dedupKeys(test.details); !reflect.DeepEqual(keys, test.want) {
+			t.Errorf("%s: dedupKeys = %q, want %q", test.name, keys, test.want)
+		}
+	}
+}
+
+func TestCertDedup(t *testing.T) {
+	dedup := newCertDedup(3)
+
+	precert := certDetails{fingerprint: "0F:29", serialNumber: "03AB", issuerFingerprint: "E6:A3", precert: true}
+	dedup.add(precert, 0)
+
+	tests := []struct {
+		name    string
+		details certDetails
+		row     int
+		found   bool
+	}{
+		{"same fingerprint", certDetails{fingerprint: "0f29"}, 0, true},
+		{"final by issuer and serial", certDetails{fingerprint: "85:2B", serialNumber: "3ab", issuerFingerprint: "e6a3"}, 0, true},
+		{"same serial, other issuer", certDetails{fingerprint: "85:2B", serialNumber: "3AB", issuerFingerprint: "11:22"}, 0, false},
+		{"unrelated", certDetails{fingerprint: "AA:BB", serialNumber: "01", issuerFingerprint: "E6:A3"}, 0, false},
+	}
+
+	for _, test := range tests {
+		if row, found := dedup.find(test.details); row != test.row || found != test.found {
+			t.Errorf("%s: find = %d, %v, want %d, %v", test.name, row, found, test.row, test.found)
+		}
+	}
+
+	// the final certificate adds its fingerprint, the shared serial key is
+	// kept rather than added twice
+	final := certDetails{fingerprint: "85:2B", serialNumber: "3AB", issuerFingerprint: "E6:A3"}
+	dedup.add(final, 0)
+	if len(dedup.keys) != 3 {
+		t.Fatalf("%d keys, want 3", len(dedup.keys))
+	}
+
+	// over the limit, the oldest key goes first
+	dedup.add(certDetails{fingerprint: "AA:BB"}, 1)
+	if _, found := dedup.find(certDetails{fingerprint: "0F:29"}); found {
+		t.Errorf("oldest key still found over the limit")
+	}
+	for _, details := range []certDetails{final, {fingerprint: "AA:BB"}} {
+		if _, found := dedup.find(details); !found {
+			t.Errorf("find(%s) = false after eviction", details.fingerprint)
+		}
+	}
+}
+
+func TestMergeDuplicate(t *testing.T) {
+	seen := time.Date(2020, 3, 27, 9, 49, 0, 0, time.UTC)
+
+	precert := certDetails{
+		commonName:     "coronavictus.com",
+		precert:        true,
+		fingerprint:    "0F:29",
+		matchedDomain:  "coronavictus.com",
+		matchedPattern: "corona",
+		registrable:    "coronavictus.com",
+		squatBrand:     "corona",
+		squatTechnique: "keyword",
+		squatScore:     0.9,
+		logs:           []string{"Argon", "Xenon"},
+		seenAs:         []string{"PrecertLogEntry"},
+	}
+	final := certDetails{
+		commonName:  "coronavictus.com",
+		fingerprint: "85:2B",
+		issuingOrg:  "Let's Encrypt",
+		logs:        []string{"Oak", "Argon"},
+		seenAs:      []string{"X509LogEntry"},
+	}
+
+	tests := []struct {
+		name      string
+		existing  certDetails
+		duplicate certDetails
+	}{
+		{"precert then final", precert, final},
+		{"final then precert", final, precert},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.existing.seen = seen
+			test.duplicate.seen = seen.Add(time.Minute)
+
+			merged := mergeDuplicate(test.existing, test.duplicate)
+
+			if merged.precert || merged.fingerprint != "85:2B" || merged.issuingOrg != "Let's Encrypt" {
+				t.Errorf("merged %s precert %v from %q, want the final certificate", merged.fingerprint, merged.precert, merged.issuingOrg)
+			}
+			if merged.precertFingerprint != "0F:29" {
+				t.Errorf("precert fingerprint %q, want 0F:29", merged.precertFingerprint)
+			}
+			if !merged.seen.Equal(seen) {
+				t.Errorf("seen %s, want the first arrival %s", merged.seen, seen)
+			}
+			if len(merged.logs) != 3 || len(merged.seenAs) != 2 {
+				t.Errorf("logs %q and types %q, want both without repeats", merged.logs, merged.seenAs)
+			}
+		})
+	}
+
+	// the precert's match carries over to the final certificate
+	merged := mergeDuplicate(precert, final)
+	if merged.matchedPattern != "corona" || merged.registrable != "coronavictus.com" || merged.squatTechnique != "keyword" || merged.squatScore != 0.9 {
+		t.Errorf("merged %+v, want the precert's match fields", merged)
+	}
+
+	// two copies of one certificate only gain logs
+	again := mergeDuplicate(final, certDetails{fingerprint: "85:2B", logs: []string{"Nimbus"}, seenAs: []string{"X509LogEntry"}})
+	if again.precertFingerprint != "" || !reflect.DeepEqual(again.logs, []string{"Oak", "Argon", "Nimbus"}) {
+		t.Errorf("merged copy %q with logs %q", again.precertFingerprint, again.logs)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks a line in a filter file as a regular expression
+const regexPrefix = "re:"
+
+// stringList collects the values of a repeatable flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// pattern is a single labelled filter term
+type pattern struct {
+	label string
+	term  string
+	re    *regexp.Regexp
+}
+
+// watchlist holds every filter pattern, compiled for the hot loop.
+// Substrings go into one Aho-Corasick automaton, so a name is scanned once
+// however many terms there are. Regexes are precompiled, and also joined into
+// a single alternation so that names matching none of them are rejected in one pass,
+// unless together they're over the regexp size limit.
+type watchlist struct {
+	substrings []pattern
+	regexes    []pattern
+	automaton  *ahoCorasick
+	combined   *regexp.Regexp
+}
+
+// Build a watchlist from the substring and regex flags plus an optional filter file
+func newWatchlist(filters []string, regexes []string, filterFile string) (*watchlist, error) {
+	w := &watchlist{}
+
+	for _, filter := range filters {
+		if err := w.add(filter, filter, false); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, expr := range regexes {
+		if err := w.add(expr, expr, true); err != nil {
+			return nil, err
+		}
+	}
+
+	if filterFile != "" {
+		if err := w.loadFile(filterFile); err != nil {
+			return nil, err
+		}
+	}
+
+	w.compile()
+
+	return w, nil
+}
+
+// Add one pattern, compiling it if it's a regex
+func (w *watchlist) add(label string, term string, isRegex bool) error {
+	if term == "" {
+		return nil
+	}
+
+	if !isRegex {
+		w.substrings = append(w.substrings, pattern{label: label, term: term})
+		return nil
+	}
+
+	re, err := regexp.Compile(term)
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %v", term, err)
+	}
+
+	w.regexes = append(w.regexes, pattern{label: label, term: term, re: re})
+	return nil
+}
+
+// Load patterns from a file, one per line, in the form
+//
+//	[label<TAB>]term
+//	[label<TAB>]re:expression
+//
+// Blank lines and lines starting with # are ignored. Without a label the term is used.
+func (w *watchlist) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		label, term := "", line
+		if i := strings.Index(line, "\t"); i >= 0 {
+			label = strings.TrimSpace(line[:i])
+			term = strings.TrimSpace(line[i+1:])
+		}
+
+		isRegex := strings.HasPrefix(term, regexPrefix)
+		if isRegex {
+			term = term[len(regexPrefix):]
+		}
+
+		if label == "" {
+			label = term
+		}
+
+		if err := w.add(label, term, isRegex); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Build the automaton and the combined regex, leaving combined nil if the
+// patterns together are too large to compile
+func (w *watchlist) compile() {
+	if len(w.substrings) > 0 {
+		terms := make([]string, len(w.substrings))
+		for i, p := range w.substrings {
+			terms[i] = p.term
+		}
+		w.automaton = newAhoCorasick(terms)
+	}
+
+	if len(w.regexes) > 0 {
+		parts := make([]string, len(w.regexes))
+		for i, p := range w.regexes {
+			parts[i] = "(?:" + p.term + ")"
+		}
+		if combined, err := regexp.Compile(strings.Join(parts, "|")); err == nil {
+			w.combined = combined
+		}
+	}
+}
+
+// Number of patterns in the watchlist
+func (w *watchlist) size() int {
+	return len(w.substrings) + len(w.regexes)
+}
+
+// Check a name against every pattern, return the label of the first hit.
+// An empty watchlist matches everything.
+func (w *watchlist) match(name string) (string, bool) {
+	if w.size() == 0 {
+		return "", true
+	}
+
+	if w.automaton != nil {
+		if i, ok := w.automaton.firstMatch(name); ok {
+			return w.substrings[i].label, true
+		}
+	}
+
+	if len(w.regexes) > 0 && (w.combined == nil || w.combined.MatchString(name)) {
+		for _, p := range w.regexes {
+			if p.re.MatchString(name) {
+				return p.label, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// ahoCorasick is a multi-pattern substring matcher
+type ahoCorasick struct {
+	next    []map[byte]int
+	fail    []int
+	outputs [][]int
+}
+
+// Build the trie, then the failure links breadth first
+func newAhoCorasick(terms []string) *ahoCorasick {
+	ac := &ahoCorasick{
+		next:    []map[byte]int{{}},
+		fail:    []int{0},
+		outputs: [][]int{nil},
+	}
+
+	for i, term := range terms {
+		node := 0
+		for j := 0; j < len(term); j++ {
+			child, ok := ac.next[node][term[j]]
+			if !ok {
+				child = len(ac.next)
+				ac.next = append(ac.next, map[byte]int{})
+				ac.fail = append(ac.fail, 0)
+				ac.outputs = append(ac.outputs, nil)
+				ac.next[node][term[j]] = child
+			}
+			node = child
+		}
+		ac.outputs[node] = append(ac.outputs[node], i)
+	}
+
+	queue := []int{}
+	for _, child := range ac.next[0] {
+		queue = append(queue, child)
+	}
+
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+
+		for b, child := range ac.next[node] {
+			queue = append(queue, child)
+
+			f := ac.fail[node]
+			for {
+				if target, ok := ac.next[f][b]; ok {
+					ac.fail[child] = target
+					break
+				}
+				if f == 0 {
+					ac.fail[child] = 0
+					break
+				}
+				f = ac.fail[f]
+			}
+
+			ac.outputs[child] = append(ac.outputs[child], ac.outputs[ac.fail[child]]...)
+		}
+	}
+
+	return ac
+}
+
+// Scan the text once, return the index of the first term found
+func (ac *ahoCorasick) firstMatch(text string) (int, bool) {
+	node := 0
+
+	for i := 0; i < len(text); i++ {
+		for {
+			if child, ok := ac.next[node][text[i]]; ok {
+				node = child
+				break
+			}
+			if node == 0 {
+				break
+			}
+			node = ac.fail[node]
+		}
+
+		if len(ac.outputs[node]) > 0 {
+			return ac.outputs[node][0], true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAhoCorasick(t *testing.T) {
+	tests := []struct {
+		name  string
+		terms []string
+		text  string
+		want  int
+		found bool
+	}{
+		{"no terms", nil, "paypal.com", 0, false},
+		{"single", []string{"paypal"}, "secure-paypal.com", 0, true},
+		{"absent", []string{"paypal"}, "paypa1.com", 0, false},
+		{"whole text", []string{"corona"}, "corona", 0, true},
+		{"earliest end wins", []string{"vibrant", "raw"}, "rawlivingvibrantenergy.com", 1, true},
+		{"longer term ending first", []string{"he", "she"}, "ushers", 1, true},
+		{"suffix via failure link", []string{"abcd", "bc"}, "xabcx", 1, true},
+		{"failure chain", []string{"aab", "ab"}, "aaab", 0, true},
+		{"overlapping prefixes", []string{"pay", "paypal", "pal"}, "mypaypal.com", 0, true},
+		{"shared prefix miss", []string{"abcde", "abcdf"}, "abcdx", 0, false},
+		{"duplicate terms", []string{"bank", "bank"}, "mybank.co.uk", 0, true},
+		{"case sensitive", []string{"PayPal"}, "paypal.com", 0, false},
+		{"multibyte", []string{"pаypal"}, "xn--pypal-4ve.com pаypal", 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i, found := newAhoCorasick(test.terms).firstMatch(test.text)
+			if found != test.found || (found && i != test.want) {
+				t.Errorf("firstMatch(%q) = %d, %v, want %d, %v", test.text, i, found, test.want, test.found)
+			}
+		})
+	}
+}
+
+// Every term the automaton finds is in the text, and it finds one whenever
+// any term is
+func TestAhoCorasickAgreesWithContains(t *testing.T) {
+	terms := []string{"a", "ab", "bab", "bc", "bca", "c", "caa", "paypal", "pal", "apple"}
+	ac := newAhoCorasick(terms)
+
+	texts := []string{"", "abccab", "xyz", "bcbcbca", "paypalapple", "zzpa", "ccaab", "applepay", "bbbbab"}
+	for _, text := range texts {
+		want := false
+		for _, term := range terms {
+			want = want || strings.Contains(text, term)
+		}
+
+		i, found := ac.firstMatch(text)
+		if found != want {
+			t.Errorf("firstMatch(%q) found = %v, want %v", text, found, want)
+		}
+		if found && !strings.Contains(text, terms[i]) {
+			t.Errorf("firstMatch(%q) = %q, which isn't in it", text, terms[i])
+		}
+	}
+}
+
+func TestWatchlist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "filters.txt")
+	err := os.WriteFile(file, []byte("# brands\npaypal\tpaypal\npaypal\tre:^pay-?pa[l1]\\.\n\ncorona\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watch, err := newWatchlist([]string{"bank"}, []string{`^secure-`}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if watch.size() != 5 {
+		t.Errorf("size = %d, want 5", watch.size())
+	}
+
+	tests := []struct {
+		name  string
+		label string
+		found bool
+	}{
+		{"mybank.com", "bank", true},
+		{"paypal-login.com", "paypal", true},
+		{"pay-pa1.com", "paypal", true},
+		{"coronavictus.com", "corona", true},
+		{"secure-login.com", "^secure-", true},
+		{"example.com", "", false},
+	}
+
+	for _, test := range tests {
+		label, found := watch.match(test.name)
+		if label != test.label || found != test.found {
+			t.Errorf("match(%q) = %q, %v, want %q, %v", test.name, label, found, test.label, test.found)
+		}
+	}
+}
+
+func TestWatchlistErrors(t *testing.T) {
+	if _, err := newWatchlist(nil, []string{"(unclosed"}, ""); err == nil {
+		t.Errorf("bad -regex accepted")
+	}
+
+	file := filepath.Join(t.TempDir(), "filters.txt")
+	if err := os.WriteFile(file, []byte("good\nlabel\tre:[bad\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newWatchlist(nil, nil, file); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("bad filter file line = %v, want an error on line 2", err)
+	}
+
+	if watch, _ := newWatchlist(nil, nil, ""); watch.size() != 0 {
+		t.Errorf("empty watchlist size = %d", watch.size())
+	} else if _, ok := watch.match("anything.com"); !ok {
+		t.Errorf("empty watchlist doesn't match everything")
+	}
+}
+
+// Regexes that compile alone but not joined still match, one at a time
+func TestWatchlistOverSizeLimit(t *testing.T) {
+	var regexes []string
+	for i := 0; i < 4000; i++ {
+		regexes = append(regexes, fmt.Sprintf("^x%d-[a-z]{1000}$", i))
+	}
+
+	watch, err := newWatchlist(nil, regexes, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if watch.combined != nil {
+		t.Fatalf("combined regex compiled, the test needs a larger watchlist")
+	}
+
+	name := "x3999-" + strings.Repeat("a", 1000)
+	if label, ok := watch.match(name); !ok || label != regexes[3999] {
+		t.Errorf("match = %q, %v, want the last regex", label, ok)
+	}
+	if _, ok := watch.match("x1-short"); ok {
+		t.Errorf("matched a name no regex matches")
+	}
+}
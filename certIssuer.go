@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+)
+
+// Take a message, fill in the issuing CA from the first chain entry and
+// the root from the last. A missing or empty chain leaves them blank.
+func getIssuerFromJSON(message *certstreamMessage, details *certDetails) {
+	chain := message.Data.Chain
+	if len(chain) == 0 {
+		return
+	}
+
+	details.issuingCA = chain[0].Subject.CN
+	details.issuingOrg = chain[0].Subject.O
+	details.issuerFingerprint = chain[0].Fingerprint
+
+	root := chain[len(chain)-1].Subject
+	details.rootCA = root.CN
+	if details.rootCA == "" {
+		details.rootCA = root.Aggregated
+	}
+}
+
+// Check the issuing CA against the -issuer filters. Each filter matches a
+// fingerprint exactly, with or without colons, or is a case insensitive
+// substring of the issuing CA's name or organisation.
+func matchIssuer(details certDetails, issuers []string) bool {
+	if len(issuers) == 0 {
+		return true
+	}
+
+	fingerprint := normaliseFingerprint(details.issuerFingerprint)
+	name := strings.ToLower(details.issuingCA)
+	org := strings.ToLower(details.issuingOrg)
+
+	for _, issuer := range issuers {
+		if fingerprint != "" && normaliseFingerprint(issuer) == fingerprint {
+			return true
+		}
+
+		issuer = strings.ToLower(issuer)
+		if strings.Contains(name, issuer) || strings.Contains(org, issuer) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Upper case a fingerprint and drop the colons
+func normaliseFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.ReplaceAll(fingerprint, ":", ""))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// registrable domains the public CAs publish their CPS under, a CPS
+// anywhere else suggests a private or rogue CA
+var knownCPSDomains = map[string]bool{
+	"accv.es":              true,
+	"actalis.it":           true,
+	"amazontrust.com":      true,
+	"buypass.com":          true,
+	"buypass.no":           true,
+	"camerfirma.com":       true,
+	"certigna.com":         true,
+	"certigna.fr":          true,
+	"certum.pl":            true,
+	"comodo.com":           true,
+	"comodoca.com":         true,
+	"cybertrust.ne.jp":     true,
+	"d-trust.net":          true,
+	"digicert.com":         true,
+	"e-szigno.hu":          true,
+	"emsign.com":           true,
+	"entrust.net":          true,
+	"firmaprofesional.com": true,
+	"geotrust.com":         true,
+	"globalsign.com":       true,
+	"godaddy.com":          true,
+	"harica.gr":            true,
+	"identrust.com":        true,
+	"izenpe.com":           true,
+	"letsencrypt.org":      true,
+	"netlock.hu":           true,
+	"pki.goog":             true,
+	"quovadisglobal.com":   true,
+	"rapidssl.com":         true,
+	"secomtrust.net":       true,
+	"sectigo.com":          true,
+	"securetrust.com":      true,
+	"ssl.com":              true,
+	"starfieldtech.com":    true,
+	"swisssign.com":        true,
+	"swisssign.net":        true,
+	"symauth.com":          true,
+	"telesec.de":           true,
+	"thawte.com":           true,
+	"trust-provider.com":   true,
+	"trustasia.com":        true,
+	"trustwave.com":        true,
+	"twca.com.tw":          true,
+	"usertrust.com":        true,
+	"zerossl.com":          true,
+}
+
+// matched certificates per CPS host, and which were unusual, for the final report
+var (
+	cpsHostCounts  = map[string]int{}
+	cpsHostUnusual = map[string]bool{}
+)
+
+// Add registrable domains, one per line with # comments, to the known CPS domains
+func loadCPSDomains(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		knownCPSDomains[normaliseDomain(line)] = true
+	}
+
+	return scanner.Err()
+}
+
+// The host part of a CPS URI, lower cased, or the whole value if it won't parse
+func cpsHost(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Hostname() == "" {
+		return strings.ToLower(uri)
+	}
+
+	return strings.ToLower(parsed.Hostname())
+}
+
+// Check a CPS URI is http or https on a known CA's domain
+func isUsualCPS(uri string) bool {
+	parsed, err := url.Parse(uri)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return false
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	if host == "" || net.ParseIP(host) != nil {
+		return false
+	}
+
+	return knownCPSDomains[publicSuffixes.registrableDomain(host)]
+}
+
+// The hosts of every CPS that isn't on a known CA's domain, without repeats
+func unusualCPSHosts(policies []CertPolicy) []string {
+	var hosts []string
+	seen := map[string]bool{}
+
+	for _, policy := range policies {
+		for _, uri := range policy.CPS {
+			host := cpsHost(uri)
+			if !isUsualCPS(uri) && !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	return hosts
+}
+
+// Check the policy qualifiers against the -cps, -notice and -unusual-cps
+// filters. Each is a case insensitive substring of any CPS URI or notice
+// text respectively.
+func matchPolicyQualifiers(details certDetails, cps []string, notices []string, unusualOnly bool) bool {
+	if unusualOnly && len(details.unusualCPS) == 0 {
+		return false
+	}
+
+	return anyQualifierContains(details.certPolicies, cps, func(p CertPolicy) []string { return p.CPS }) &&
+		anyQualifierContains(details.certPolicies, notices, func(p CertPolicy) []string { return p.Notices })
+}
+
+// Check any qualifier picked from the policies contains any of the terms,
+// true when there are no terms
+func anyQualifierContains(policies []CertPolicy, terms []string, qualifiers func(CertPolicy) []string) bool {
+	if len(terms) == 0 {
+		return true
+	}
+
+	for _, policy := range policies {
+		for _, value := range qualifiers(policy) {
+			value = strings.ToLower(value)
+			for _, term := range terms {
+				if strings.Contains(value, strings.ToLower(term)) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Count a matched certificate against each of its CPS hosts, and log any unusual ones
+func noteCPSHosts(details certDetails) {
+	seen := map[string]bool{}
+
+	for _, policy := range details.certPolicies {
+		for _, uri := range policy.CPS {
+			if host := cpsHost(uri); !seen[host] {
+				seen[host] = true
+				cpsHostCounts[host]++
+			}
+		}
+	}
+
+	for _, host := range details.unusualCPS {
+		cpsHostUnusual[host] = true
+	}
+
+	if len(details.unusualCPS) > 0 {
+		log.Printf("Unusual CPS host %q on %q, issued by %q", strings.Join(details.unusualCPS, ", "), details.commonName, details.issuingCA)
+	}
+}
+
+// Print the CPS hosts seen on matches, most common first
+func printCPSHosts(w io.Writer) {
+	hosts := make([]string, 0, len(cpsHostCounts))
+	for host := range cpsHostCounts {
+		hosts = append(hosts, host)
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		if cpsHostCounts[hosts[i]] != cpsHostCounts[hosts[j]] {
+			return cpsHostCounts[hosts[i]] > cpsHostCounts[hosts[j]]
+		}
+		return hosts[i] < hosts[j]
+	})
+
+	fmt.Fprintln(w, "\nCPS Host\tMatches\tUnusual")
+	for _, host := range hosts {
+		fmt.Fprintf(w, "%s\t%d\t%t\n", host, cpsHostCounts[host], cpsHostUnusual[host])
+	}
+}
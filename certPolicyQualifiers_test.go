@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// A DER value with the given tag
+func testASN1(t *testing.T, tag int, bytes []byte) asn1.RawValue {
+	t.Helper()
+
+	der, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: tag, Bytes: bytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return asn1.RawValue{FullBytes: der}
+}
+
+// A certificate whose certificatePolicies extension is built from policies
+func testPolicyCert(t *testing.T, policies []policyInformation) *x509.Certificate {
+	t.Helper()
+
+	value, err := asn1.Marshal(policies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: "example.com"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: oidCertificatePolicies, Value: value}},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestPolicyQualifiersFromDER(t *testing.T) {
+	// a UserNotice with a noticeRef ahead of a UTF8String explicitText
+	noticeRef := testASN1(t, asn1.TagSequence, append(testASN1(t, asn1.TagUTF8String, []byte("Example CA")).FullBytes,
+		testASN1(t, asn1.TagSequence, []byte{2, 1, 1}).FullBytes...))
+	notice := testASN1(t, asn1.TagSequence, append(noticeRef.FullBytes,
+		testASN1(t, asn1.TagUTF8String, []byte("Relying party agreement applies")).FullBytes...))
+
+	// and one with a BMPString explicitText alone
+	var bmp []byte
+	for _, r := range utf16.Encode([]rune("Für Prüfzwecke")) {
+		bmp = append(bmp, byte(r>>8), byte(r))
+	}
+	bmpNotice := testASN1(t, asn1.TagSequence, testASN1(t, asn1.TagBMPString, bmp).FullBytes)
+
+	cert := testPolicyCert(t, []policyInformation{
+		{Policy: asn1.ObjectIdentifier{2, 23, 140, 1, 2, 2}},
+		{Policy: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}, Qualifiers: []policyQualifier{
+			{ID: oidQualifierCPS, Qualifier: testASN1(t, asn1.TagIA5String, []byte("https://www.example.com/cps"))},
+			{ID: oidQualifierUserNotice, Qualifier: notice},
+			{ID: oidQualifierCPS, Qualifier: testASN1(t, asn1.TagIA5String, []byte("http://repository.example.net/"))},
+		}},
+		{Policy: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}, Qualifiers: []policyQualifier{
+			{ID: oidQualifierUserNotice, Qualifier: bmpNotice},
+		}},
+	})
+
+	want := []CertPolicy{
+		{OID: "2.23.140.1.2.2", Name: "CA/B Forum Organization Validated"},
+		{OID: "1.3.6.1.4.1.99999.1", Name: "Unknown", CPS: []string{"https://www.example.com/cps", "http://repository.example.net/"}, Notices: []string{"Relying party agreement applies"}},
+		{OID: "1.3.6.1.4.1.99999.2", Name: "Unknown", Notices: []string{"Für Prüfzwecke"}},
+	}
+
+	validation := ClassifyCertValidation(renderPolicies(cert))
+	if !reflect.DeepEqual(validation.Policies, want) {
+		t.Errorf("policies %+v, want %+v", validation.Policies, want)
+	}
+	if validation.Level != LevelOV {
+		t.Errorf("level %s, want OV", validation.Level)
+	}
+}
+
+func TestIsUsualCPS(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want bool
+	}{
+		{"https://www.digicert.com/CPS", true},
+		{"http://cps.letsencrypt.org", true},
+		{"https://sectigo.com/CPS", true},
+		{"HTTPS://Repository.GlobalSign.com/repository/", true},
+		{"https://pki.goog/repository/", true},
+		{"https://digicert.com.example.net/cps", false},
+		{"https://cps.example.com", false},
+		{"ftp://www.digicert.com/CPS", false},
+		{"https://192.0.2.1/cps", false},
+		{"www.digicert.com/CPS", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := isUsualCPS(test.uri); got != test.want {
+			t.Errorf("isUsualCPS(%q) = %v, want %v", test.uri, got, test.want)
+		}
+	}
+}
+
+func TestUnusualCPSHosts(t *testing.T) {
+	policies := []CertPolicy{
+		{OID: "1.2.3", CPS: []string{"https://www.digicert.com/CPS", "https://ca.example.com/cps"}},
+		{OID: "1.2.4", CPS: []string{"http://CA.example.com/other", "ftp://files.example.org/cps"}},
+	}
+
+	want := []string{"ca.example.com", "files.example.org"}
+	if hosts := unusualCPSHosts(policies); !reflect.DeepEqual(hosts, want) {
+		t.Errorf("unusualCPSHosts = %q, want %q", hosts, want)
+	}
+}
+
+func TestLoadCPSDomains(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cps.txt")
+	if err := os.WriteFile(file, []byte("# internal CAs\nExample.com\n\n  pki.example.org.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if isUsualCPS("https://ca.example.com/cps") {
+		t.Fatalf("example.com known before loading")
+	}
+
+	if err := loadCPSDomains(file); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		delete(knownCPSDomains, "example.com")
+		delete(knownCPSDomains, "pki.example.org")
+	}()
+
+	if !isUsualCPS("https://ca.example.com/cps") {
+		t.Errorf("loaded domain not known")
+	}
+	if !knownCPSDomains["pki.example.org"] || !isUsualCPS("https://www.digicert.com/CPS") {
+		t.Errorf("known domains %v", knownCPSDomains)
+	}
+}
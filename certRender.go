@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// OIDs needed to render extensions the way certstream does
+var (
+	oidCertificatePolicies = asn1.ObjectIdentifier{2, 5, 29, 32}
+	oidQualifierCPS        = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 1}
+	oidQualifierUserNotice = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 2}
+	oidSubjectCountry      = asn1.ObjectIdentifier{2, 5, 4, 6}
+	oidSubjectState        = asn1.ObjectIdentifier{2, 5, 4, 8}
+	oidSubjectLocality     = asn1.ObjectIdentifier{2, 5, 4, 7}
+	oidSubjectOrganisation = asn1.ObjectIdentifier{2, 5, 4, 10}
+	oidSubjectUnit         = asn1.ObjectIdentifier{2, 5, 4, 11}
+	oidSubjectCommonName   = asn1.ObjectIdentifier{2, 5, 4, 3}
+)
+
+// subject fields in the order certstream aggregates them
+var subjectFields = []struct {
+	key   string
+	oid   asn1.ObjectIdentifier
+	field func(*certSubject) *string
+}{
+	{"C", oidSubjectCountry, func(s *certSubject) *string { return &s.C }},
+	{"ST", oidSubjectState, func(s *certSubject) *string { return &s.ST }},
+	{"L", oidSubjectLocality, func(s *certSubject) *string { return &s.L }},
+	{"O", oidSubjectOrganisation, func(s *certSubject) *string { return &s.O }},
+	{"OU", oidSubjectUnit, func(s *certSubject) *string { return &s.OU }},
+	{"CN", oidSubjectCommonName, func(s *certSubject) *string { return &s.CN }},
+}
+
+// Render a parsed certificate into the same shape as certstream's
+// leaf_cert and chain entries, so it can go through getCertDetailsFromJSON
+func renderCertificate(cert *x509.Certificate) certstreamCert {
+	var extensions certExtensions
+
+	if len(cert.DNSNames) > 0 {
+		names := make([]string, len(cert.DNSNames))
+		for i, name := range cert.DNSNames {
+			names[i] = "DNS:" + name
+		}
+		subjectAltName := strings.Join(names, ", ")
+		extensions.SubjectAltName = &subjectAltName
+	}
+
+	if policies := renderPolicies(cert); policies != "" {
+		extensions.CertificatePolicies = &policies
+	}
+
+	if cert.BasicConstraintsValid {
+		basicConstraints := "CA:FALSE"
+		if cert.IsCA {
+			basicConstraints = "CA:TRUE"
+		}
+		extensions.BasicConstraints = &basicConstraints
+	}
+
+	allDomains := []string{}
+	seen := map[string]bool{}
+	for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			allDomains = append(allDomains, name)
+		}
+	}
+
+	return certstreamCert{
+		Subject:      renderName(cert.Subject),
+		Extensions:   extensions,
+		NotBefore:    float64(cert.NotBefore.Unix()),
+		NotAfter:     float64(cert.NotAfter.Unix()),
+		SerialNumber: fmt.Sprintf("%X", cert.SerialNumber),
+		Fingerprint:  sha1Fingerprint(cert.Raw),
+		AsDER:        base64.StdEncoding.EncodeToString(cert.Raw),
+		AllDomains:   allDomains,
+	}
+}
+
+// Render a distinguished name as certstream's subject, with the
+// "/C=../CN=.." aggregated form
+func renderName(name pkix.Name) certSubject {
+	var subject certSubject
+
+	for _, field := range subjectFields {
+		for _, attr := range name.Names {
+			if attr.Type.Equal(field.oid) {
+				value := fmt.Sprint(attr.Value)
+				*field.field(&subject) = value
+				subject.Aggregated += "/" + field.key + "=" + value
+				break
+			}
+		}
+	}
+
+	return subject
+}
+
+// SHA1 of the DER, upper case hex split by colons, as certstream prints it
+func sha1Fingerprint(der []byte) string {
+	sum := sha1.Sum(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// policyInformation and policyQualifier follow RFC 5280 section 4.2.1.4
+type policyInformation struct {
+	Policy     asn1.ObjectIdentifier
+	Qualifiers []policyQualifier `asn1:"optional"`
+}
+
+type policyQualifier struct {
+	ID        asn1.ObjectIdentifier
+	Qualifier asn1.RawValue
+}
+
+// Pull the explicitText out of a UserNotice, skipping any noticeRef sequence
+func explicitText(qualifier asn1.RawValue) string {
+	var notice asn1.RawValue
+	if _, err := asn1.Unmarshal(qualifier.FullBytes, &notice); err != nil {
+		return ""
+	}
+
+	rest := notice.Bytes
+	for len(rest) > 0 {
+		var element asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &element); err != nil {
+			return ""
+		}
+
+		switch element.Tag {
+		case asn1.TagSequence:
+			continue
+		case asn1.TagBMPString:
+			// UTF-16 big endian
+			runes := make([]uint16, len(element.Bytes)/2)
+			for i := range runes {
+				runes[i] = uint16(element.Bytes[2*i])<<8 | uint16(element.Bytes[2*i+1])
+			}
+			return string(utf16.Decode(runes))
+		default:
+			return string(element.Bytes)
+		}
+	}
+
+	return ""
+}
+
+// Render the certificatePolicies extension as the OpenSSL style text
+// certstream sends, "Policy: <oid>" with indented CPS and User Notice lines
+func renderPolicies(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidCertificatePolicies) {
+			continue
+		}
+
+		var policies []policyInformation
+		if _, err := asn1.Unmarshal(ext.Value, &policies); err != nil {
+			return ""
+		}
+
+		var rendered strings.Builder
+		for _, policy := range policies {
+			rendered.WriteString("Policy: " + policy.Policy.String() + "\n")
+
+			for _, qualifier := range policy.Qualifiers {
+				switch {
+				case qualifier.ID.Equal(oidQualifierCPS):
+					var cps string
+					if _, err := asn1.Unmarshal(qualifier.Qualifier.FullBytes, &cps); err == nil {
+						rendered.WriteString("  CPS: " + cps + "\n")
+					}
+				case qualifier.ID.Equal(oidQualifierUserNotice):
+					rendered.WriteString("  User Notice:\n")
+					if text := explicitText(qualifier.Qualifier); text != "" {
+						rendered.WriteString("    Explicit Text: " + text + "\n")
+					}
+				}
+			}
+		}
+
+		return rendered.String()
+	}
+
+	return ""
+}
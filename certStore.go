@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// bbolt buckets, the certificates by fingerprint and an index per field.
+// Index keys are the value, a zero byte, the big endian seen time in
+// nanoseconds, then the fingerprint, so a time window is a range scan.
+// by_run indexes the run that last matched each certificate, and by_key
+// maps the fingerprint and issuer plus serial keys certDedup uses to the
+// fingerprint, so duplicates are merged across the whole store.
+var (
+	bucketCerts    = []byte("certs")
+	bucketByDomain = []byte("by_domain")
+	bucketByIssuer = []byte("by_issuer")
+	bucketByLevel  = []byte("by_level")
+	bucketBySeen   = []byte("by_seen")
+	bucketByRun    = []byte("by_run")
+	bucketByKey    = []byte("by_key")
+
+	storeBuckets = [][]byte{bucketCerts, bucketByDomain, bucketByIssuer, bucketByLevel, bucketBySeen, bucketByRun, bucketByKey}
+)
+
+// certStore persists matched certificates as they arrive
+type certStore struct {
+	db *bolt.DB
+
+	// this run, tagged on every certificate it writes
+	run string
+}
+
+// storedCert is a match as written to the store
+type storedCert struct {
+	CommonName         string    `json:"common_name"`
+	Aggregated         string    `json:"aggregated"`
+	MatchedDomain      string    `json:"matched_domain"`
+	MatchedPattern     string    `json:"matched_pattern"`
+	Registrable        string    `json:"registrable"`
+	PublicSuffix       string    `json:"public_suffix"`
+	UpdateType         string    `json:"update_type"`
+	Level              string    `json:"level"`
+	Validation         string    `json:"validation"`
+	IssuingCA          string    `json:"issuing_ca"`
+	IssuingOrg         string    `json:"issuing_org"`
+	IssuerFingerprint  string    `json:"issuer_fingerprint"`
+	IssuerName         string    `json:"issuer_name"`
+	RootCA             string    `json:"root_ca"`
+	Fingerprint        string    `json:"fingerprint"`
+	SerialNumber       string    `json:"serial_number"`
+	PrecertFingerprint string    `json:"precert_fingerprint,omitempty"`
+	Precert            bool      `json:"precert"`
+	KeyAlgorithm       string    `json:"key_algorithm,omitempty"`
+	KeySize            int       `json:"key_size,omitempty"`
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	DERMismatch        []string  `json:"der_mismatch,omitempty"`
+	UnusualCPS         []string  `json:"unusual_cps,omitempty"`
+	Lookalike          string    `json:"lookalike,omitempty"`
+	LookalikeTechnique string    `json:"lookalike_technique,omitempty"`
+	LookalikeScore     float64   `json:"lookalike_score,omitempty"`
+	SeenAs             []string  `json:"seen_as"`
+	Logs               []string  `json:"logs"`
+	Domains            []string  `json:"domains"`
+	Seen               time.Time `json:"seen"`
+	Run                string    `json:"run,omitempty"`
+}
+
+// Open or create the store
+func openCertStore(path string) (*certStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range storeBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &certStore{db: db, run: strconv.FormatInt(time.Now().UnixNano(), 10)}, nil
+}
+
+// Open an existing store to read, failing rather than creating a missing
+// file or bucket
+func openCertStoreReadOnly(path string) (*certStore, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, name := range storeBuckets {
+			if tx.Bucket(name) == nil {
+				return fmt.Errorf("%s has no %s bucket, is it a store?", path, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &certStore{db: db}, nil
+}
+
+func (s *certStore) Close() error {
+	return s.db.Close()
+}
+
+// Write a match, replacing any earlier version of it. A final certificate
+// replaces its precert, which is stored under a different fingerprint.
+func (s *certStore) put(details certDetails) error {
+	cert := toStoredCert(details)
+	cert.Run = s.run
+	fingerprint := []byte(normaliseFingerprint(cert.Fingerprint))
+
+	value, err := json.Marshal(cert)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, fingerprint := range []string{details.precertFingerprint, details.fingerprint} {
+			if err := removeStoredCert(tx, fingerprint); err != nil {
+				return err
+			}
+		}
+
+		for bucket, keys := range indexKeys(cert) {
+			for _, key := range keys {
+				if err := tx.Bucket([]byte(bucket)).Put(key, nil); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, key := range dedupKeys(details) {
+			if err := tx.Bucket(bucketByKey).Put([]byte(key), fingerprint); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(bucketCerts).Put(fingerprint, value)
+	})
+}
+
+// The stored certificate sharing a fingerprint, or issuer and serial, with
+// this one, if any
+func (s *certStore) find(details certDetails) (certDetails, bool, error) {
+	var found certDetails
+	var ok bool
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, key := range dedupKeys(details) {
+			fingerprint := tx.Bucket(bucketByKey).Get([]byte(key))
+			if fingerprint == nil {
+				continue
+			}
+
+			value := tx.Bucket(bucketCerts).Get(fingerprint)
+			if value == nil {
+				continue
+			}
+
+			var cert storedCert
+			if err := json.Unmarshal(value, &cert); err != nil {
+				return fmt.Errorf("%s: %v", fingerprint, err)
+			}
+			found, ok = fromStoredCert(cert), true
+			return nil
+		}
+		return nil
+	})
+
+	return found, ok, err
+}
+
+// The certificates this run matched, oldest first
+func (s *certStore) runMatches() ([]certDetails, error) {
+	stored, err := s.query(bucketByRun, s.run, time.Unix(0, 0), time.Unix(0, math.MaxInt64))
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]certDetails, len(stored))
+	for i, cert := range stored {
+		matches[i] = fromStoredCert(cert)
+	}
+
+	return matches, nil
+}
+
+// Delete a certificate and its index entries, if stored
+func removeStoredCert(tx *bolt.Tx, fingerprint string) error {
+	if fingerprint == "" {
+		return nil
+	}
+
+	key := []byte(normaliseFingerprint(fingerprint))
+	value := tx.Bucket(bucketCerts).Get(key)
+	if value == nil {
+		return nil
+	}
+
+	var old storedCert
+	if err := json.Unmarshal(value, &old); err != nil {
+		return err
+	}
+
+	for bucket, keys := range indexKeys(old) {
+		for _, indexKey := range keys {
+			if err := tx.Bucket([]byte(bucket)).Delete(indexKey); err != nil {
+				return err
+			}
+		}
+	}
+
+	// only the keys still pointing here, a newer certificate may have taken them
+	for _, dedupKey := range dedupKeys(fromStoredCert(old)) {
+		if bytes.Equal(tx.Bucket(bucketByKey).Get([]byte(dedupKey)), key) {
+			if err := tx.Bucket(bucketByKey).Delete([]byte(dedupKey)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Bucket(bucketCerts).Delete(key)
+}
+
+// Every index entry for a stored certificate, by bucket. Domains are every
+// name on it plus the registrable domain, all lower cased.
+func indexKeys(cert storedCert) map[string][][]byte {
+	seen := uint64(cert.Seen.UnixNano())
+	fingerprint := normaliseFingerprint(cert.Fingerprint)
+
+	domains := appendUnique(nil, cert.Registrable)
+	for _, domain := range cert.Domains {
+		domains = appendUnique(domains, strings.ToLower(domain))
+	}
+
+	keys := map[string][][]byte{
+		string(bucketByIssuer): {indexKey(strings.ToLower(cert.IssuingCA), seen, fingerprint)},
+		string(bucketByLevel):  {indexKey(strings.ToLower(cert.Level), seen, fingerprint)},
+		string(bucketBySeen):   {indexKey("", seen, fingerprint)},
+	}
+	if cert.Run != "" {
+		keys[string(bucketByRun)] = [][]byte{indexKey(cert.Run, seen, fingerprint)}
+	}
+	for _, domain := range domains {
+		keys[string(bucketByDomain)] = append(keys[string(bucketByDomain)], indexKey(domain, seen, fingerprint))
+	}
+
+	return keys
+}
+
+// value, 0, seen time, fingerprint
+func indexKey(value string, seen uint64, fingerprint string) []byte {
+	key := make([]byte, 0, len(value)+9+len(fingerprint))
+	key = append(key, value...)
+	key = append(key, 0)
+	key = binary.BigEndian.AppendUint64(key, seen)
+	return append(key, fingerprint...)
+}
+
+// The certificates seen in [since, until) with the given index value, or
+// all of them if bucket is by_seen, oldest first
+func (s *certStore) query(bucket []byte, value string, since time.Time, until time.Time) ([]storedCert, error) {
+	var certs []storedCert
+
+	prefix := append([]byte(strings.ToLower(value)), 0)
+	from := binary.BigEndian.AppendUint64(append([]byte(nil), prefix...), uint64(since.UnixNano()))
+	to := binary.BigEndian.AppendUint64(append([]byte(nil), prefix...), uint64(until.UnixNano()))
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		certBucket := tx.Bucket(bucketCerts)
+		cursor := tx.Bucket(bucket).Cursor()
+
+		for key, _ := cursor.Seek(from); key != nil && bytes.Compare(key, to) < 0; key, _ = cursor.Next() {
+			fingerprint := key[len(prefix)+8:]
+
+			value := certBucket.Get(fingerprint)
+			if value == nil {
+				continue
+			}
+
+			var cert storedCert
+			if err := json.Unmarshal(value, &cert); err != nil {
+				return fmt.Errorf("%s: %v", fingerprint, err)
+			}
+			certs = append(certs, cert)
+		}
+
+		return nil
+	})
+
+	sort.SliceStable(certs, func(i, j int) bool { return certs[i].Seen.Before(certs[j].Seen) })
+
+	return certs, err
+}
+
+// Copy a match's table fields into the stored form
+func toStoredCert(details certDetails) storedCert {
+	return storedCert{
+		CommonName:         details.commonName,
+		Aggregated:         details.aggregatedName,
+		MatchedDomain:      details.matchedDomain,
+		MatchedPattern:     details.matchedPattern,
+		Registrable:        details.registrable,
+		PublicSuffix:       details.publicSuffix,
+		UpdateType:         details.updateType,
+		Level:              details.level.String(),
+		Validation:         details.validation,
+		IssuingCA:          details.issuingCA,
+		IssuingOrg:         details.issuingOrg,
+		IssuerFingerprint:  details.issuerFingerprint,
+		IssuerName:         details.issuerName,
+		RootCA:             details.rootCA,
+		Fingerprint:        details.fingerprint,
+		SerialNumber:       details.serialNumber,
+		PrecertFingerprint: details.precertFingerprint,
+		Precert:            details.precert,
+		KeyAlgorithm:       details.keyAlgorithm,
+		KeySize:            details.keySize,
+		NotBefore:          details.notBefore,
+		NotAfter:           details.notAfter,
+		DERMismatch:        details.derMismatch,
+		UnusualCPS:         details.unusualCPS,
+		Lookalike:          details.squatBrand,
+		LookalikeTechnique: details.squatTechnique,
+		LookalikeScore:     details.squatScore,
+		SeenAs:             details.seenAs,
+		Logs:               details.logs,
+		Domains:            details.allDomains,
+		Seen:               details.seen,
+	}
+}
+
+// And back again, for the table
+func fromStoredCert(cert storedCert) certDetails {
+	level := LevelUnknown
+	for l := LevelUnknown; l <= LevelEV; l++ {
+		if l.String() == cert.Level {
+			level = l
+		}
+	}
+
+	return certDetails{
+		commonName:         cert.CommonName,
+		aggregatedName:     cert.Aggregated,
+		matchedDomain:      cert.MatchedDomain,
+		matchedPattern:     cert.MatchedPattern,
+		registrable:        cert.Registrable,
+		publicSuffix:       cert.PublicSuffix,
+		updateType:         cert.UpdateType,
+		level:              level,
+		validation:         cert.Validation,
+		issuingCA:          cert.IssuingCA,
+		issuingOrg:         cert.IssuingOrg,
+		issuerFingerprint:  cert.IssuerFingerprint,
+		issuerName:         cert.IssuerName,
+		rootCA:             cert.RootCA,
+		fingerprint:        cert.Fingerprint,
+		serialNumber:       cert.SerialNumber,
+		precertFingerprint: cert.PrecertFingerprint,
+		precert:            cert.Precert,
+		keyAlgorithm:       cert.KeyAlgorithm,
+		keySize:            cert.KeySize,
+		notBefore:          cert.NotBefore,
+		notAfter:           cert.NotAfter,
+		derMismatch:        cert.DERMismatch,
+		unusualCPS:         cert.UnusualCPS,
+		squatBrand:         cert.Lookalike,
+		squatTechnique:     cert.LookalikeTechnique,
+		squatScore:         cert.LookalikeScore,
+		seenAs:             cert.SeenAs,
+		logs:               cert.Logs,
+		allDomains:         cert.Domains,
+		seen:               cert.Seen,
+	}
+}
+
+// Parse a -since or -until value, either a time or a duration before now
+func parseQueryTime(value string, now time.Time) (time.Time, error) {
+	if ago, err := time.ParseDuration(value); err == nil {
+		return now.Add(-ago), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%q is neither a time like 2006-01-02T15:04:05Z nor a duration like 24h", value)
+}
+
+// Print the table of matches stored in a time window, returning the exit code
+func queryCommand(args []string) int {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	storePtr := flags.String("store", "certificates.db", "Store to read matches from")
+	sincePtr := flags.String("since", "24h", "Start of the window, as a time or a duration before now")
+	untilPtr := flags.String("until", "0s", "End of the window, as a time or a duration before now")
+	domainPtr := flags.String("domain", "", "Only matches with this name or registrable domain")
+	issuerPtr := flags.String("issuer", "", "Only matches from this issuing CA name")
+	levelPtr := flags.String("validation", "", "Only matches at this validation level: dv, iv, ov, ev or unknown")
+	flags.Parse(args)
+
+	now := time.Now()
+	since, err := parseQueryTime(*sincePtr, now)
+	if err != nil {
+		log.Printf("Error: -since %v", err)
+		return 1
+	}
+	until, err := parseQueryTime(*untilPtr, now)
+	if err != nil {
+		log.Printf("Error: -until %v", err)
+		return 1
+	}
+
+	// pick the narrowest index
+	bucket, value := bucketBySeen, ""
+	switch {
+	case *domainPtr != "":
+		bucket, value = bucketByDomain, normaliseDomain(*domainPtr)
+	case *issuerPtr != "":
+		bucket, value = bucketByIssuer, *issuerPtr
+	case *levelPtr != "":
+		bucket, value = bucketByLevel, *levelPtr
+	}
+
+	store, err := openCertStoreReadOnly(*storePtr)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return 1
+	}
+	defer store.Close()
+
+	stored, err := store.query(bucket, value, since, until)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return 1
+	}
+
+	// the other filters, if more than one was given
+	var matches []certDetails
+	for _, cert := range stored {
+		if *issuerPtr != "" && !strings.EqualFold(cert.IssuingCA, *issuerPtr) {
+			continue
+		}
+		if *levelPtr != "" && !strings.EqualFold(cert.Level, *levelPtr) {
+			continue
+		}
+		matches = append(matches, fromStoredCert(cert))
+	}
+
+	log.Printf("Matches from %s to %s: %d", since.UTC().Format(time.RFC3339), until.UTC().Format(time.RFC3339), len(matches))
+
+	writer := new(tabwriter.Writer)
+	writer.Init(os.Stdout, 0, 8, 4, '\t', 0)
+	printMatches(writer, matches)
+
+	return 0
+}
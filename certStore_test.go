@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestStore(t *testing.T, path string) *certStore {
+	t.Helper()
+
+	store, err := openCertStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestCertStoreMergesPrecert(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "matches.db")
+	store := openTestStore(t, path)
+
+	seen := time.Date(2020, 3, 27, 9, 49, 0, 0, time.UTC)
+	precert := certDetails{
+		commonName:        "coronavictus.com",
+		updateType:        "PrecertLogEntry",
+		precert:           true,
+		fingerprint:       "0F:29:28:7D",
+		serialNumber:      "03AB",
+		issuerFingerprint: "E6:A3:B4:5B",
+		matchedDomain:     "coronavictus.com",
+		matchedPattern:    "corona",
+		logs:              []string{"Google 'Argon2020' log"},
+		seenAs:            []string{"PrecertLogEntry"},
+		seen:              seen,
+	}
+	final := certDetails{
+		commonName:        "coronavictus.com",
+		updateType:        "X509LogEntry",
+		fingerprint:       "85:2B:97:96",
+		serialNumber:      "3AB",
+		issuerFingerprint: "E6:A3:B4:5B",
+		logs:              []string{"Let's Encrypt 'Oak2020' log"},
+		seenAs:            []string{"X509LogEntry"},
+		seen:              seen.Add(time.Minute),
+	}
+
+	if _, ok, err := store.find(precert); err != nil || ok {
+		t.Fatalf("find in an empty store = %v, %v", ok, err)
+	}
+	if err := store.put(precert); err != nil {
+		t.Fatal(err)
+	}
+
+	// the final certificate is found by issuer and serial
+	existing, ok, err := store.find(final)
+	if err != nil || !ok {
+		t.Fatalf("find final = %v, %v", ok, err)
+	}
+	if !existing.precert || existing.fingerprint != precert.fingerprint {
+		t.Fatalf("found %+v, want the precert", existing)
+	}
+
+	if err := store.put(mergeDuplicate(existing, final)); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := store.runMatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("runMatches = %d rows, want 1", len(matches))
+	}
+	merged := matches[0]
+	if merged.fingerprint != final.fingerprint || merged.precertFingerprint != precert.fingerprint {
+		t.Errorf("fingerprints %q and %q, want the final's and the precert's", merged.fingerprint, merged.precertFingerprint)
+	}
+	if merged.matchedPattern != "corona" || !merged.seen.Equal(seen) || len(merged.logs) != 2 {
+		t.Errorf("merged %+v, want the precert's match and time with both logs", merged)
+	}
+
+	// a precert from another log still finds the merged row
+	if existing, ok, _ := store.find(precert); !ok || existing.fingerprint != final.fingerprint {
+		t.Errorf("find precert again = %q, %v, want the final certificate", existing.fingerprint, ok)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a later run finds the match, but doesn't list it until it matches again
+	store = openTestStore(t, path)
+	defer store.Close()
+
+	if _, ok, _ := store.find(final); !ok {
+		t.Errorf("find after reopening = false")
+	}
+	if matches, _ := store.runMatches(); len(matches) != 0 {
+		t.Errorf("runMatches in a new run = %d rows, want 0", len(matches))
+	}
+}
+
+func TestOpenCertStoreReadOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	// a missing store isn't created
+	missing := filepath.Join(dir, "missing.db")
+	if _, err := openCertStoreReadOnly(missing); err == nil {
+		t.Errorf("opened a missing store")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("missing store created: %v", err)
+	}
+
+	// nor are the buckets of a database that isn't a store
+	other := filepath.Join(dir, "other.db")
+	db, err := bolt.Open(other, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := openCertStoreReadOnly(other); err == nil {
+		t.Errorf("opened a database without the store buckets")
+	}
+
+	// a store is read, and can be opened twice
+	path := filepath.Join(dir, "matches.db")
+	store := openTestStore(t, path)
+	seen := time.Now().Add(-time.Hour)
+	if err := store.put(certDetails{commonName: "coronavictus.com", fingerprint: "0F:29", seen: seen}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	first, err := openCertStoreReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := openCertStoreReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	certs, err := second.query(bucketBySeen, "", seen.Add(-time.Minute), time.Now())
+	if err != nil || len(certs) != 1 || certs[0].CommonName != "coronavictus.com" {
+		t.Errorf("query = %d certificates, %v, want the stored match", len(certs), err)
+	}
+}
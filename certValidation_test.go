@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmbeddedPolicies(t *testing.T) {
+	table := &policyTable{names: map[string]string{}}
+	problems, err := table.load(strings.NewReader(embeddedPolicies), "certificate_policies.csv")
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("load = %v, %v", problems, err)
+	}
+
+	tests := []struct {
+		oid  string
+		name string
+	}{
+		{"2.23.140.1.1", "CA/B Forum Extended Validation"},
+		{"2.23.140.1.2.1", "CA/B Forum Domain Validated"},
+		{"0.4.0.2042.1.2", "ETSI NCP+"},
+	}
+
+	for _, test := range tests {
+		if name := table.names[test.oid]; name != test.name {
+			t.Errorf("%s = %q, want %q", test.oid, name, test.name)
+		}
+	}
+}
+
+func TestPolicyTableLoad(t *testing.T) {
+	table := &policyTable{names: map[string]string{}}
+
+	// columns in any order, extra ones ignored, Short Name standing in for Name
+	_, err := table.load(strings.NewReader("Type,Short Name,OID\nEV, Example EV ,1.3.6.1.4.1.99999.1\nDV,Example DV,1.3.6.1.4.1.99999.2\n"), "first.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a later file replaces earlier names
+	_, err = table.load(strings.NewReader("OID,Name\n1.3.6.1.4.1.99999.2,Example Domain Validated\n"), "second.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"1.3.6.1.4.1.99999.1": "Example EV",
+		"1.3.6.1.4.1.99999.2": "Example Domain Validated",
+	}
+	for oid, name := range want {
+		if table.names[oid] != name {
+			t.Errorf("%s = %q, want %q", oid, table.names[oid], name)
+		}
+	}
+	if len(table.names) != len(want) {
+		t.Errorf("%d names, want %d", len(table.names), len(want))
+	}
+}
+
+func TestPolicyTableLoadProblems(t *testing.T) {
+	table := &policyTable{names: map[string]string{}}
+	problems, err := table.load(strings.NewReader("Name,OID\n"+
+		"Good,2.23.140.1.2.1\n"+
+		"Leading zero,2.23.0140\n"+
+		",2.23.140.1.2.2\n"+
+		"Short\n"+
+		"Again,2.23.140.1.2.1\n"), "test.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"is not a valid OID", "has no name", "is missing columns", "duplicates line 2"}
+	if len(problems) != len(want) {
+		t.Fatalf("problems = %v, want %d", problems, len(want))
+	}
+	for i, problem := range problems {
+		if problem.reason != want[i] || problem.line != i+3 {
+			t.Errorf("problem %d = %s, want line %d %s", i, problem, i+3, want[i])
+		}
+	}
+
+	// the later row still replaces the earlier one
+	if name := table.names["2.23.140.1.2.1"]; name != "Again" {
+		t.Errorf("name = %q, want the later row", name)
+	}
+
+	if _, err := table.load(strings.NewReader("Policy,Description\n"), "test.csv"); err == nil {
+		t.Errorf("load accepted a header without OID and Name")
+	}
+}
+
+func TestClassifyCertValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies string
+		level    ValidationLevel
+		names    []string
+	}{
+		{"DV", "Policy: 2.23.140.1.2.1\n", LevelDV, []string{"CA/B Forum Domain Validated"}},
+		{"IV", "Policy: 2.23.140.1.2.3\n", LevelIV, []string{"CA/B Forum Individual Validated"}},
+		{"OV", "Policy: 2.23.140.1.2.2\n", LevelOV, []string{"CA/B Forum Organization Validated"}},
+		{"EV", "Policy: 2.23.140.1.1\n", LevelEV, []string{"CA/B Forum Extended Validation"}},
+		{"highest wins", "Policy: 2.23.140.1.1\nPolicy: 2.23.140.1.2.1\n", LevelEV, []string{"CA/B Forum Extended Validation", "CA/B Forum Domain Validated"}},
+		{"vendor policy alongside", "Policy: 1.3.6.1.4.1.44947.1.1.1\n  CPS: http://cps.letsencrypt.org\nPolicy: 2.23.140.1.2.1\n", LevelDV, nil},
+		{"baseline requirements arc isn't a level", "Policy: 2.23.140.1.2\n", LevelUnknown, []string{"CA/B Forum Baseline Requirements"}},
+		{"unlisted", "Policy: 1.2.3.4\n", LevelUnknown, []string{"Unknown"}},
+		{"none", "", LevelUnknown, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			validation := ClassifyCertValidation(test.policies)
+			if validation.Level != test.level {
+				t.Errorf("level %s, want %s", validation.Level, test.level)
+			}
+			if test.names != nil && strings.Join(validation.Names, "|") != strings.Join(test.names, "|") {
+				t.Errorf("names %q, want %q", validation.Names, test.names)
+			}
+		})
+	}
+}
+
+func TestParseValidationLevels(t *testing.T) {
+	levels, err := parseValidationLevels("ev, OV,,unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 3 || !levels[LevelEV] || !levels[LevelOV] || !levels[LevelUnknown] {
+		t.Errorf("levels = %v, want EV, OV and Unknown", levels)
+	}
+
+	if _, err := parseValidationLevels("ev,xv"); err == nil {
+		t.Errorf("unknown level accepted")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// certstreamMessage is one decoded message from the stream, kept with the
+// raw bytes it came from so it can be archived as received
+type certstreamMessage struct {
+	MessageType string      `json:"message_type"`
+	Data        messageData `json:"data"`
+	Timestamp   float64     `json:"timestamp"`
+
+	raw []byte
+}
+
+type messageData struct {
+	UpdateType string           `json:"update_type"`
+	LeafCert   *certstreamCert  `json:"leaf_cert"`
+	Chain      []certstreamCert `json:"chain"`
+	CertIndex  int64            `json:"cert_index"`
+	CertLink   string           `json:"cert_link"`
+	Seen       float64          `json:"seen"`
+	Source     messageSource    `json:"source"`
+
+	// dns_entries messages carry just a list of names as their data
+	Domains []string `json:"-"`
+}
+
+// Decode data as a certificate update, or as the list of names a
+// dns_entries message carries
+func (d *messageData) UnmarshalJSON(raw []byte) error {
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		return json.Unmarshal(raw, &d.Domains)
+	}
+
+	// a plain type decodes without coming back here
+	type plainData messageData
+	err := json.Unmarshal(raw, (*plainData)(d))
+
+	// the nested decode doesn't know it's under data
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		typeErr.Field = "data." + typeErr.Field
+	}
+
+	return err
+}
+
+type messageSource struct {
+	URL  string `json:"url"`
+	Name string `json:"name"`
+}
+
+// certstreamCert is a leaf_cert or chain entry
+type certstreamCert struct {
+	Subject      certSubject    `json:"subject"`
+	Extensions   certExtensions `json:"extensions"`
+	NotBefore    float64        `json:"not_before"`
+	NotAfter     float64        `json:"not_after"`
+	SerialNumber string         `json:"serial_number"`
+	Fingerprint  string         `json:"fingerprint"`
+	AsDER        string         `json:"as_der"`
+	AllDomains   []string       `json:"all_domains"`
+}
+
+// certSubject fields are null when absent from the certificate, which
+// decodes as empty
+type certSubject struct {
+	Aggregated string `json:"aggregated"`
+	C          string `json:"C"`
+	ST         string `json:"ST"`
+	L          string `json:"L"`
+	O          string `json:"O"`
+	OU         string `json:"OU"`
+	CN         string `json:"CN"`
+}
+
+// certExtensions holds the rendered extensions we read, nil when absent.
+// Others, some of which aren't strings, are ignored.
+type certExtensions struct {
+	SubjectAltName      *string `json:"subjectAltName,omitempty"`
+	CertificatePolicies *string `json:"certificatePolicies,omitempty"`
+	BasicConstraints    *string `json:"basicConstraints,omitempty"`
+}
+
+// fieldError names the message field that was missing or malformed
+type fieldError struct {
+	path    string
+	problem string
+}
+
+func (e *fieldError) Error() string {
+	return e.path + " " + e.problem
+}
+
+// decodeError is a message that couldn't be decoded, kept for the dead letter file
+type decodeError struct {
+	raw []byte
+	err error
+}
+
+func (e *decodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *decodeError) Unwrap() error {
+	return e.err
+}
+
+// Decode a raw message, naming the field on a type mismatch
+func decodeMessage(raw []byte) (*certstreamMessage, error) {
+	message := &certstreamMessage{raw: raw}
+
+	if err := json.Unmarshal(raw, message); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			err = &fieldError{typeErr.Field, fmt.Sprintf("is a %s, want %s", typeErr.Value, typeErr.Type)}
+		}
+		return nil, &decodeError{raw, err}
+	}
+
+	return message, nil
+}
+
+// The message as received, or for one built by a CT log source, encoded
+// the first time it's needed
+func (m *certstreamMessage) rawJSON() []byte {
+	if m.raw == nil {
+		m.raw, _ = json.Marshal(m)
+	}
+	return m.raw
+}
+
+// The leaf certificate, or an error naming it if the message has none
+func (m *certstreamMessage) leaf() (*certstreamCert, error) {
+	if m.Data.LeafCert == nil {
+		return nil, &fieldError{"data.leaf_cert", "is missing"}
+	}
+
+	return m.Data.LeafCert, nil
+}
+
+// The name of the CT log the message came from, or its URL if unnamed
+func messageLog(m *certstreamMessage) string {
+	if m.Data.Source.Name != "" {
+		return m.Data.Source.Name
+	}
+	return m.Data.Source.URL
+}
+
+// When certstream saw the certificate, zero if not given
+func (m *certstreamMessage) seen() time.Time {
+	return unixTime(m.Data.Seen)
+}
+
+// A fractional unix timestamp as a time, zero for zero
+func unixTime(seconds float64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
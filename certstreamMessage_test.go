@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	example, err := os.ReadFile("example_cert.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		raw         string
+		messageType string
+		check       func(t *testing.T, message *certstreamMessage)
+	}{
+		{"certificate_update", string(example), typeUpdate, func(t *testing.T, message *certstreamMessage) {
+			leaf, err := message.leaf()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if leaf.Subject.CN != "rawlivingvibrantenergy.com" || leaf.Subject.O != "" || !reflect.DeepEqual(leaf.AllDomains, []string{"rawlivingvibrantenergy.com"}) {
+				t.Errorf("leaf subject %+v with domains %q", leaf.Subject, leaf.AllDomains)
+			}
+			if message.Data.UpdateType != "X509LogEntry" || message.Data.CertIndex != 163947593 || len(message.Data.Chain) != 2 {
+				t.Errorf("data %s entry %d with %d chain certificates", message.Data.UpdateType, message.Data.CertIndex, len(message.Data.Chain))
+			}
+			if messageLog(message) != "Google 'Rocketeer' log" || message.seen().Unix() != 1510095720 {
+				t.Errorf("from %q seen %s", messageLog(message), message.seen())
+			}
+		}},
+		{"heartbeat", `{"message_type": "heartbeat", "timestamp": 1584546695.5}`, "heartbeat", func(t *testing.T, message *certstreamMessage) {
+			if message.Timestamp != 1584546695.5 {
+				t.Errorf("timestamp %v", message.Timestamp)
+			}
+			if _, err := message.leaf(); err == nil {
+				t.Errorf("heartbeat has a leaf")
+			}
+		}},
+		{"dns_entries", `{"message_type": "dns_entries", "data": ["example.com", "www.example.com"]}`, "dns_entries", func(t *testing.T, message *certstreamMessage) {
+			if !reflect.DeepEqual(message.Data.Domains, []string{"example.com", "www.example.com"}) {
+				t.Errorf("domains %q", message.Data.Domains)
+			}
+		}},
+		{"null subject fields", `{"message_type": "certificate_update", "data": {"leaf_cert": {"subject": {"CN": null, "O": "Example Ltd"}}}}`, typeUpdate, func(t *testing.T, message *certstreamMessage) {
+			if subject := message.Data.LeafCert.Subject; subject.CN != "" || subject.O != "Example Ltd" {
+				t.Errorf("subject %+v", subject)
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := decodeMessage([]byte(test.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message.MessageType != test.messageType {
+				t.Errorf("message_type %q, want %q", message.MessageType, test.messageType)
+			}
+			if string(message.rawJSON()) != test.raw {
+				t.Errorf("raw bytes not kept")
+			}
+			test.check(t, message)
+		})
+	}
+}
+
+func TestDecodeMessageErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   string
+		field string
+	}{
+		{"truncated", `{"message_type": "certificate_update", "data": {"leaf_cert": {`, ""},
+		{"not json", `certificate_update`, ""},
+		{"wrong typed cert_index", `{"message_type": "certificate_update", "data": {"cert_index": "163947593"}}`, "data.cert_index"},
+		{"wrong typed fingerprint", `{"message_type": "certificate_update", "data": {"leaf_cert": {"fingerprint": 12}}}`, "data.leaf_cert.fingerprint"},
+		{"wrong typed all_domains", `{"message_type": "certificate_update", "data": {"leaf_cert": {"all_domains": "example.com"}}}`, "data.leaf_cert.all_domains"},
+		{"wrong typed message_type", `{"message_type": 1}`, "message_type"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodeMessage([]byte(test.raw))
+
+			var decodeErr *decodeError
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("error %v, want a decodeError", err)
+			}
+			if string(decodeErr.raw) != test.raw {
+				t.Errorf("decodeError kept %q", decodeErr.raw)
+			}
+
+			var fieldErr *fieldError
+			if found := errors.As(err, &fieldErr); found != (test.field != "") {
+				t.Fatalf("error %v, want a fieldError: %v", err, test.field != "")
+			}
+			if test.field != "" && fieldErr.path != test.field {
+				t.Errorf("fieldError on %q, want %q", fieldErr.path, test.field)
+			}
+		})
+	}
+}
+
+// A message built from a certificate reads back the same once encoded
+func TestWrapCertificatesRoundTrip(t *testing.T) {
+	ca := newTestCA(t)
+	leaf, err := x509.ParseCertificate(ca.issue(t, "coronavictus.com", 100, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := time.Date(2020, 3, 27, 9, 49, 0, 0, time.UTC)
+	message := wrapCertificates("X509LogEntry", seen, leaf, []*x509.Certificate{ca.cert}, 7, "link", "test.example/log", "Test log")
+
+	decoded, err := decodeMessage(message.rawJSON())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded.raw = message.raw
+	if !reflect.DeepEqual(decoded, message) {
+		t.Errorf("decoded %+v, want %+v", decoded, message)
+	}
+
+	details, err := getCertDetailsFromJSON(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.commonName != "coronavictus.com" || details.issuingCA != "Test Issuing CA" || details.issuingOrg != "Test CA Ltd" || !decoded.seen().Equal(seen) {
+		t.Errorf("details %q from %q, %q seen %s", details.commonName, details.issuingCA, details.issuingOrg, decoded.seen())
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MerkleTreeLeaf entry types, RFC 6962 section 3.4
+const (
+	ctX509Entry    = 0
+	ctPrecertEntry = 1
+)
+
+// ctLog is one RFC 6962 log to poll
+type ctLog struct {
+	name    string
+	url     string // as certstream reports it, without the scheme
+	baseURL string
+}
+
+// Build the log list from -ct-log URLs and an optional file of
+// [name<TAB>]url lines
+func loadCTLogs(urls []string, path string) ([]ctLog, error) {
+	var logs []ctLog
+
+	for _, url := range urls {
+		logs = append(logs, newCTLog("", url))
+	}
+
+	if path == "" {
+		return logs, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, url := "", line
+		if i := strings.Index(line, "\t"); i >= 0 {
+			name = strings.TrimSpace(line[:i])
+			url = strings.TrimSpace(line[i+1:])
+		}
+
+		logs = append(logs, newCTLog(name, url))
+	}
+
+	return logs, scanner.Err()
+}
+
+// Normalise a log URL, defaulting to https when no scheme is given
+func newCTLog(name string, url string) ctLog {
+	url = strings.TrimSuffix(url, "/")
+
+	baseURL := url
+	if !strings.Contains(url, "://") {
+		baseURL = "https://" + url
+	}
+
+	bare := url
+	if i := strings.Index(bare, "://"); i >= 0 {
+		bare = bare[i+3:]
+	}
+
+	if name == "" {
+		name = bare
+	}
+
+	return ctLog{name: name, url: bare, baseURL: baseURL}
+}
+
+// ctCheckpoint records the next index to fetch from each log, keyed on URL
+type ctCheckpoint struct {
+	mu   sync.Mutex
+	path string
+	next map[string]int64
+}
+
+// Load the checkpoint file, a missing file is an empty checkpoint
+func loadCTCheckpoint(path string) (*ctCheckpoint, error) {
+	checkpoint := &ctCheckpoint{path: path, next: map[string]int64{}}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &checkpoint.next); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return checkpoint, nil
+}
+
+func (c *ctCheckpoint) get(url string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	next, ok := c.next[url]
+	return next, ok
+}
+
+// Set the next index for a log and write the file, via a rename so a crash
+// can't leave it half written
+func (c *ctCheckpoint) set(url string, next int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.next[url] = next
+
+	data, err := json.MarshalIndent(c.next, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(c.path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(c.path+".tmp", c.path)
+}
+
+// ctPoller fetches entries from RFC 6962 logs
+type ctPoller struct {
+	client     *http.Client
+	checkpoint *ctCheckpoint
+	poll       time.Duration
+	batch      int64
+}
+
+// ctLogStream polls each log's get-sth and get-entries directly, decoding the
+// MerkleTreeLeaf entries into certstream shaped messages on the same channels
+// as the live stream. Logs without a checkpoint start from their current head.
+func ctLogStream(logs []ctLog, checkpoint *ctCheckpoint, poll time.Duration, batch int) (chan *certstreamMessage, chan error) {
+	stream := make(chan *certstreamMessage)
+	errStream := make(chan error)
+
+	poller := &ctPoller{
+		client:     &http.Client{Timeout: 30 * time.Second},
+		checkpoint: checkpoint,
+		poll:       poll,
+		batch:      int64(batch),
+	}
+
+	for _, ctl := range logs {
+		go poller.run(ctl, stream, errStream)
+	}
+
+	return stream, errStream
+}
+
+// Poll one log forever
+func (p *ctPoller) run(ctl ctLog, stream chan *certstreamMessage, errStream chan error) {
+	next, started := p.checkpoint.get(ctl.url)
+
+	for {
+		size, err := p.getSTH(ctl)
+		if err != nil {
+			errStream <- err
+			time.Sleep(p.poll)
+			continue
+		}
+
+		if !started {
+			next, started = size, true
+			if err := p.checkpoint.set(ctl.url, next); err != nil {
+				errStream <- err
+			}
+		}
+
+		for next < size {
+			end := next + p.batch
+			if end > size {
+				end = size
+			}
+
+			// logs may return fewer entries than asked for
+			entries, err := p.getEntries(ctl, next, end-1)
+			if err != nil {
+				errStream <- err
+				break
+			}
+
+			if len(entries) == 0 {
+				break
+			}
+
+			for i, entry := range entries {
+				message, err := buildCTMessage(ctl, next+int64(i), entry.LeafInput, entry.ExtraData)
+				if err != nil {
+					errStream <- err
+					continue
+				}
+				stream <- message
+			}
+
+			next += int64(len(entries))
+			if err := p.checkpoint.set(ctl.url, next); err != nil {
+				errStream <- err
+			}
+		}
+
+		time.Sleep(p.poll)
+	}
+}
+
+// Fetch and decode a JSON response from the log
+func (p *ctPoller) getJSON(url string, target interface{}) error {
+	response, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, response.Status)
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(target); err != nil {
+		return fmt.Errorf("%s: %v", url, err)
+	}
+
+	return nil
+}
+
+// Return the log's current tree size
+func (p *ctPoller) getSTH(ctl ctLog) (int64, error) {
+	var sth struct {
+		TreeSize int64 `json:"tree_size"`
+	}
+
+	err := p.getJSON(ctl.baseURL+"/ct/v1/get-sth", &sth)
+	return sth.TreeSize, err
+}
+
+// ctEntry is one entry from get-entries, base64 decoded by encoding/json
+type ctEntry struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+}
+
+// Fetch entries start to end inclusive
+func (p *ctPoller) getEntries(ctl ctLog, start int64, end int64) ([]ctEntry, error) {
+	var response struct {
+		Entries []ctEntry `json:"entries"`
+	}
+
+	err := p.getJSON(fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", ctl.baseURL, start, end), &response)
+	return response.Entries, err
+}
+
+// Decode a MerkleTreeLeaf and its extra_data into a certstream message.
+// Precert leaves only hold the TBSCertificate, so the leaf_cert is rendered
+// from the pre_certificate in extra_data, poison extension and all, as
+// certstream does.
+func buildCTMessage(ctl ctLog, index int64, leafInput []byte, extraData []byte) (*certstreamMessage, error) {
+	updateType, timestamp, leaf, chain, err := decodeCTEntry(leafInput, extraData)
+	if err != nil {
+		return nil, fmt.Errorf("%s entry %d: %v", ctl.url, index, err)
+	}
+
+	return wrapCertificates(updateType, timestamp, leaf, chain, index,
+		fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", ctl.baseURL, index, index),
+		ctl.url, ctl.name), nil
+}
+
+// Wrap parsed certificates in the certstream message shape, seen at the
+// log's timestamp for the entry
+func wrapCertificates(updateType string, timestamp time.Time, leaf *x509.Certificate, chain []*x509.Certificate, index int64, link string, url string, name string) *certstreamMessage {
+	renderedChain := make([]certstreamCert, len(chain))
+	for i, cert := range chain {
+		renderedChain[i] = renderCertificate(cert)
+	}
+	renderedLeaf := renderCertificate(leaf)
+
+	return &certstreamMessage{
+		MessageType: typeUpdate,
+		Data: messageData{
+			UpdateType: updateType,
+			LeafCert:   &renderedLeaf,
+			Chain:      renderedChain,
+			CertIndex:  index,
+			CertLink:   link,
+			Seen:       float64(timestamp.UnixNano()) / float64(time.Second),
+			Source:     messageSource{URL: url, Name: name},
+		},
+	}
+}
+
+// Split the leaf and extra_data into the update type, the log's timestamp,
+// leaf and chain
+func decodeCTEntry(leafInput []byte, extraData []byte) (string, time.Time, *x509.Certificate, []*x509.Certificate, error) {
+	// version, leaf_type, timestamp, entry_type
+	if len(leafInput) < 12 || leafInput[0] != 0 || leafInput[1] != 0 {
+		return "", time.Time{}, nil, nil, fmt.Errorf("unsupported MerkleTreeLeaf")
+	}
+
+	timestamp := time.UnixMilli(int64(binary.BigEndian.Uint64(leafInput[2:10])))
+	entryType := binary.BigEndian.Uint16(leafInput[10:12])
+	body := leafInput[12:]
+
+	var leafDER []byte
+	var updateType string
+	var err error
+
+	switch entryType {
+	case ctX509Entry:
+		updateType = "X509LogEntry"
+		if leafDER, _, err = readOpaque24(body); err != nil {
+			return "", time.Time{}, nil, nil, err
+		}
+	case ctPrecertEntry:
+		updateType = "PrecertLogEntry"
+		if leafDER, extraData, err = readOpaque24(extraData); err != nil {
+			return "", time.Time{}, nil, nil, err
+		}
+	default:
+		return "", time.Time{}, nil, nil, fmt.Errorf("unknown entry type %d", entryType)
+	}
+
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return "", time.Time{}, nil, nil, err
+	}
+
+	chain, err := decodeCTChain(extraData)
+	if err != nil {
+		return "", time.Time{}, nil, nil, err
+	}
+
+	return updateType, timestamp, leaf, chain, nil
+}
+
+// Parse an ASN.1Cert chain, a 24 bit length followed by 24 bit length prefixed certificates
+func decodeCTChain(data []byte) ([]*x509.Certificate, error) {
+	list, _, err := readOpaque24(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*x509.Certificate
+	for len(list) > 0 {
+		var der []byte
+		if der, list, err = readOpaque24(list); err != nil {
+			return nil, err
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+
+	return chain, nil
+}
+
+// Read a 24 bit length prefixed value, returning it and the remainder
+func readOpaque24(data []byte) ([]byte, []byte, error) {
+	if len(data) < 3 {
+		return nil, nil, fmt.Errorf("truncated entry")
+	}
+
+	length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	if len(data) < 3+length {
+		return nil, nil, fmt.Errorf("truncated entry")
+	}
+
+	return data[3 : 3+length], data[3+length:], nil
+}
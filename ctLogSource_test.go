@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCA is an issuer for test certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Issuing CA", Organization: []string{"Test CA Ltd"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testCA{cert, key}
+}
+
+// Issue a leaf for name, a precert carrying the poison extension if asked
+func (ca testCA) issue(t *testing.T, name string, serial int64, precert bool) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name, "www." + name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	if precert {
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oidPrecertPoison, Critical: true, Value: []byte{5, 0}})
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+// A 24 bit length prefix
+func opaque24(data []byte) []byte {
+	return append([]byte{byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+// The leaf_input and extra_data get-entries returns for a certificate the
+// log added at logged
+func testCTEntry(leafDER []byte, issuerDER []byte, precert bool, logged time.Time) ctEntry {
+	leaf := []byte{0, 0}
+	leaf = binary.BigEndian.AppendUint64(leaf, uint64(logged.UnixMilli()))
+
+	chain := opaque24(opaque24(issuerDER))
+
+	if !precert {
+		leaf = binary.BigEndian.AppendUint16(leaf, ctX509Entry)
+		leaf = append(leaf, opaque24(leafDER)...)
+		leaf = append(leaf, 0, 0)
+		return ctEntry{LeafInput: leaf, ExtraData: chain}
+	}
+
+	// issuer_key_hash and a stand in TBSCertificate, the pre_certificate is
+	// what's rendered
+	leaf = binary.BigEndian.AppendUint16(leaf, ctPrecertEntry)
+	leaf = append(leaf, make([]byte, 32)...)
+	leaf = append(leaf, opaque24([]byte("tbs"))...)
+	leaf = append(leaf, 0, 0)
+	return ctEntry{LeafInput: leaf, ExtraData: append(opaque24(leafDER), chain...)}
+}
+
+// Serve get-sth and get-entries for entries, returning at most batch per call
+func newTestCTLog(t *testing.T, entries []ctEntry, batch int) *httptest.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/ct/v1/get-sth", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"tree_size": len(entries)})
+	})
+
+	mux.HandleFunc("/ct/v1/get-entries", func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		end, _ := strconv.Atoi(r.URL.Query().Get("end"))
+		if start < 0 || end >= len(entries) || start > end {
+			http.Error(w, "bad range", http.StatusBadRequest)
+			return
+		}
+		if end-start+1 > batch {
+			end = start + batch - 1
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"entries": entries[start : end+1]})
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Wait for count messages, failing on a stream error
+func receiveMessages(t *testing.T, stream chan *certstreamMessage, errStream chan error, count int) []*certstreamMessage {
+	t.Helper()
+
+	var messages []*certstreamMessage
+	timeout := time.After(5 * time.Second)
+
+	for len(messages) < count {
+		select {
+		case message := <-stream:
+			messages = append(messages, message)
+		case err := <-errStream:
+			t.Fatalf("stream error: %v", err)
+		case <-timeout:
+			t.Fatalf("got %d messages, want %d", len(messages), count)
+		}
+	}
+
+	return messages
+}
+
+func TestCTLogStream(t *testing.T) {
+	ca := newTestCA(t)
+
+	logged := time.Date(2020, 3, 27, 9, 49, 0, 123e6, time.UTC)
+	entries := []ctEntry{
+		testCTEntry(ca.issue(t, "zero.example.com", 100, false), ca.cert.Raw, false, logged),
+		testCTEntry(ca.issue(t, "one.example.com", 101, true), ca.cert.Raw, true, logged.Add(1*time.Second)),
+		testCTEntry(ca.issue(t, "two.example.com", 102, false), ca.cert.Raw, false, logged.Add(2*time.Second)),
+		testCTEntry(ca.issue(t, "three.example.com", 103, false), ca.cert.Raw, false, logged.Add(3*time.Second)),
+	}
+
+	// the log returns fewer entries than asked for
+	server := newTestCTLog(t, entries, 2)
+	ctl := newCTLog("test", server.URL)
+
+	// resume after the first entry
+	checkpoint, err := loadCTCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkpoint.set(ctl.url, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, errStream := ctLogStream([]ctLog{ctl}, checkpoint, time.Hour, 256)
+	messages := receiveMessages(t, stream, errStream, 3)
+
+	tests := []struct {
+		index      int64
+		updateType string
+		name       string
+	}{
+		{1, "PrecertLogEntry", "one.example.com"},
+		{2, "X509LogEntry", "two.example.com"},
+		{3, "X509LogEntry", "three.example.com"},
+	}
+
+	for i, test := range tests {
+		message := messages[i]
+		if message.Data.CertIndex != test.index || message.Data.UpdateType != test.updateType {
+			t.Errorf("message %d is entry %d %s, want %d %s", i, message.Data.CertIndex, message.Data.UpdateType, test.index, test.updateType)
+		}
+
+		// seen is when the log added the entry, to the millisecond
+		if want := logged.Add(time.Duration(test.index) * time.Second); message.seen().Sub(want).Abs() > time.Microsecond {
+			t.Errorf("entry %d seen %s, want the log's timestamp %s", test.index, message.seen().UTC(), want)
+		}
+
+		name, issuer := message.Data.LeafCert.Subject.CN, message.Data.Chain[0].Subject.CN
+		if name != test.name || issuer != "Test Issuing CA" || message.Data.Source.Name != "test" {
+			t.Errorf("entry %d: %q from %q in %q, want %q from the test CA", test.index, name, issuer, message.Data.Source.Name, test.name)
+		}
+	}
+
+	// the checkpoint is at the head, and saved
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		saved, err := loadCTCheckpoint(checkpoint.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next, _ := saved.get(ctl.url); next == int64(len(entries)) {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("checkpoint at %d, want %d", next, len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCTLogStreamStartsAtHead(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestCTLog(t, []ctEntry{testCTEntry(ca.issue(t, "old.example.com", 1, false), ca.cert.Raw, false, time.Now())}, 256)
+	ctl := newCTLog("", server.URL)
+
+	checkpoint, err := loadCTCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, errStream := ctLogStream([]ctLog{ctl}, checkpoint, time.Hour, 256)
+
+	select {
+	case message := <-stream:
+		t.Errorf("got entry %d from before the head", message.Data.CertIndex)
+	case err := <-errStream:
+		t.Errorf("stream error: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if next, ok := checkpoint.get(ctl.url); !ok || next != 1 {
+		t.Errorf("checkpoint = %d, %v, want the head at 1", next, ok)
+	}
+}
+
+func TestDecodeCTEntryErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry ctEntry
+	}{
+		{"empty", ctEntry{}},
+		{"wrong version", ctEntry{LeafInput: append([]byte{1, 0}, make([]byte, 10)...)}},
+		{"unknown type", ctEntry{LeafInput: append(make([]byte, 10), 0, 7)}},
+		{"truncated", ctEntry{LeafInput: append(make([]byte, 12), 0, 0, 9)}},
+		{"not a certificate", ctEntry{LeafInput: append(make([]byte, 12), opaque24([]byte("junk"))...)}},
+	}
+
+	for _, test := range tests {
+		if _, _, _, _, err := decodeCTEntry(test.entry.LeafInput, test.entry.ExtraData); err == nil {
+			t.Errorf("%s: decodeCTEntry succeeded", test.name)
+		}
+	}
+}
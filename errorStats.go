@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// error categories, in report order
+const (
+	errorStream  = "stream"
+	errorDecode  = "decode"
+	errorDomains = "domains"
+	errorDetails = "details"
+	errorDER     = "der"
+)
+
+var errorCategories = []string{errorStream, errorDecode, errorDomains, errorDetails, errorDER}
+
+var (
+	// errors per category, and per field named in the error
+	errorsByCategory = map[string]int{}
+	errorsByField    = map[string]int{}
+
+	// total at the last periodic log, to skip quiet intervals
+	errorsLogged int
+
+	// failed messages and why, if -dead-letter is set
+	deadLetters *deadLetterFile
+)
+
+// deadLetterFile appends failed messages as JSON lines
+type deadLetterFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// deadLetter is one line of the dead letter file. Messages that aren't
+// valid JSON are written as a string.
+type deadLetter struct {
+	Time     string      `json:"time"`
+	Category string      `json:"category"`
+	Reason   string      `json:"reason"`
+	Message  interface{} `json:"message"`
+}
+
+// Open the dead letter file for appending
+func openDeadLetters(path string) (*deadLetterFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deadLetterFile{file: file}, nil
+}
+
+func (d *deadLetterFile) write(category string, reason error, raw []byte) error {
+	letter := deadLetter{
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Category: category,
+		Reason:   reason.Error(),
+		Message:  string(raw),
+	}
+	if json.Valid(raw) {
+		letter.Message = json.RawMessage(raw)
+	}
+
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err = d.file.Write(append(line, '\n'))
+	return err
+}
+
+func (d *deadLetterFile) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.file.Close()
+}
+
+// Count an error against its category and any field it names, and write
+// the message that caused it, if there was one, to the dead letter file
+func noteError(category string, err error, raw []byte) {
+	countErrors++
+	errorsByCategory[category]++
+	metricErrors.WithLabelValues(category).Inc()
+
+	var fieldErr *fieldError
+	if errors.As(err, &fieldErr) {
+		errorsByField[fieldErr.path]++
+	}
+
+	if deadLetters != nil && raw != nil {
+		if writeErr := deadLetters.write(category, err, raw); writeErr != nil {
+			log.Printf("Error writing dead letter: %q", writeErr)
+		}
+	}
+}
+
+// Count an error from a source, which is a decode failure if it carries
+// the message that couldn't be decoded
+func noteStreamError(err error) {
+	var decodeErr *decodeError
+	if errors.As(err, &decodeErr) {
+		noteError(errorDecode, err, decodeErr.raw)
+		return
+	}
+
+	noteError(errorStream, err, nil)
+}
+
+// Log the error counts, if there have been any since last time
+func logErrorCounts() {
+	if countErrors == errorsLogged {
+		return
+	}
+	errorsLogged = countErrors
+
+	log.Printf("Errors: %d (%s), missing or malformed: %s", countErrors, formatCounts(errorsByCategory, errorCategories), formatCounts(errorsByField, nil))
+}
+
+// Format counts as "a=1, b=2", in the given order or by count if none
+func formatCounts(counts map[string]int, order []string) string {
+	if order == nil {
+		order = sortedByCount(counts)
+	}
+
+	var parts []string
+	for _, key := range order {
+		if counts[key] > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", key, counts[key]))
+		}
+	}
+
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Keys most counted first
+func sortedByCount(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	return keys
+}
+
+// Print the errors by category and by field
+func printErrorCounts(w io.Writer) {
+	fmt.Fprintln(w, "\nError Category\tCount")
+	for _, category := range errorCategories {
+		fmt.Fprintf(w, "%s\t%d\n", category, errorsByCategory[category])
+	}
+
+	if len(errorsByField) > 0 {
+		fmt.Fprintln(w, "\nError Field\tCount")
+		for _, field := range sortedByCount(errorsByField) {
+			fmt.Fprintf(w, "%s\t%d\n", field, errorsByField[field])
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// leaf_cert fields whose presence is counted, in report order
+var completenessFields = []struct {
+	path    string
+	present func(cert *certstreamCert) bool
+}{
+	{"subject.CN", func(c *certstreamCert) bool { return c.Subject.CN != "" }},
+	{"subject.O", func(c *certstreamCert) bool { return c.Subject.O != "" }},
+	{"subject.aggregated", func(c *certstreamCert) bool { return c.Subject.Aggregated != "" }},
+	{"extensions.subjectAltName", func(c *certstreamCert) bool { return c.Extensions.SubjectAltName != nil }},
+	{"extensions.certificatePolicies", func(c *certstreamCert) bool { return c.Extensions.CertificatePolicies != nil }},
+	{"all_domains", func(c *certstreamCert) bool { return len(c.AllDomains) > 0 }},
+	{"fingerprint", func(c *certstreamCert) bool { return c.Fingerprint != "" }},
+	{"serial_number", func(c *certstreamCert) bool { return c.SerialNumber != "" }},
+	{"not_before", func(c *certstreamCert) bool { return c.NotBefore != 0 }},
+	{"not_after", func(c *certstreamCert) bool { return c.NotAfter != 0 }},
+	{"as_der", func(c *certstreamCert) bool { return c.AsDER != "" }},
+}
+
+// how many leaf certs had each field, indexed as completenessFields, and
+// how many there were in all
+var (
+	fieldPresent   = make([]int, len(completenessFields))
+	countLeafCerts int
+)
+
+// Count which fields the message's leaf_cert has, including those we don't
+// otherwise need, so the report shows how much of the stream lacks them
+func trackCompleteness(message *certstreamMessage) {
+	cert := message.Data.LeafCert
+	if cert == nil {
+		return
+	}
+
+	countLeafCerts++
+	for i, field := range completenessFields {
+		if field.present(cert) {
+			fieldPresent[i]++
+		}
+	}
+}
+
+// Print the share of leaf certs with each field
+func printCompleteness(w io.Writer) {
+	fmt.Fprintln(w, "\nField\tPresent\tMissing\tComplete")
+
+	for i, field := range completenessFields {
+		complete := 0.0
+		if countLeafCerts > 0 {
+			complete = 100 * float64(fieldPresent[i]) / float64(countLeafCerts)
+		}
+
+		fmt.Fprintf(w, "leaf_cert.%s\t%d\t%d\t%.1f%%\n", field.path, fieldPresent[i], countLeafCerts-fieldPresent[i], complete)
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
@@ -10,12 +14,14 @@ import (
 	"syscall"
 	"text/tabwriter"
 	"time"
-
-	"github.com/CaliDog/certstream-go"
-	"github.com/jmoiron/jsonq"
 )
 
-const typeUpdate = "certificate_update"
+// certstream message types
+const (
+	typeUpdate     = "certificate_update"
+	typeHeartbeat  = "heartbeat"
+	typeDNSEntries = "dns_entries"
+)
 
 var (
 	// Global counts printed before exit in cleanup
@@ -24,8 +30,30 @@ var (
 	countErrors    int
 	start          time.Time
 
-	// slice in which we store the details
+	// messages that aren't certificate updates
+	countHeartbeats    int
+	countDNSEntries    int
+	countOtherMessages int
+
+	// slice in which we store the details, unless they're in the store
 	certificates []certDetails
+
+	// raw message archive, if recording
+	archive *recorder
+
+	// persistent store of matches, if -store is set
+	store *certStore
+
+	// structured match records, if -output is jsonl or csv, and where the
+	// final tables go
+	matches *matchSink
+	reports io.Writer = os.Stdout
+
+	// webhooks to alert on matches, if -webhook is set
+	alerts *webhookSink
+
+	// where to write unknown policy OIDs on exit, if anywhere
+	unknownPoliciesFile string
 )
 
 type certDetails struct {
@@ -34,55 +62,401 @@ type certDetails struct {
 	updateType     string
 	fingerprint    string
 	validation     string
+	level          ValidationLevel
+	policyNames    []string
+	policyIDs      []string
+	certPolicies   []CertPolicy
+	unusualCPS     []string
+	allDomains     []string
+	matchedDomain  string
+	matchedPattern string
+	publicSuffix   string
+	registrable    string
+	keyAlgorithm   string
+	keySize        int
+	notBefore      time.Time
+	notAfter       time.Time
+	issuerName     string
+	precert        bool
+	fromDER        bool
+	derMismatch    []string
+
+	// where the certificate was seen, merged across duplicates
+	serialNumber       string
+	logs               []string
+	seenAs             []string
+	precertFingerprint string
+	seen               time.Time
+
+	// the protected brand the matched name imitates, if -brands matched it
+	squatBrand     string
+	squatTechnique string
+	squatScore     float64
+
+	issuingCA         string
+	issuingOrg        string
+	issuerFingerprint string
+	rootCA            string
 }
 
 func main() {
-	filterPtr := flag.String("filter", "", "Filter term for certificate common name")
-	tldPtr := flag.String("tld", "", "Top Level Domain to filter")
+	// subcommands come before the flags
+	if len(os.Args) > 1 && os.Args[1] == "validate-policies" {
+		os.Exit(validatePoliciesCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		os.Exit(queryCommand(os.Args[2:]))
+	}
+
+	var filters, regexes stringList
+	flag.Var(&filters, "filter", "Filter term for certificate names, may be repeated")
+	flag.Var(&regexes, "regex", "Regular expression filter for certificate names, may be repeated")
+	filterFilePtr := flag.String("filter-file", "", "File of filter patterns, one per line as [label<TAB>]term or [label<TAB>]re:expression")
+	tldPtr := flag.String("tld", "", "Top Level Domain or public suffix to filter, e.g. uk or co.uk")
+	var registrables stringList
+	flag.Var(&registrables, "domain", "Registrable domain (eTLD+1) to filter, may be repeated")
+	pslPtr := flag.String("psl", "", "Load the Public Suffix List from a local file instead of the embedded snapshot")
 	hosePtr := flag.Bool("hose", false, "show the raw stream")
+	policiesPtr := flag.String("policies", "", "Policy CSV in the zmap format to merge over the embedded policy table")
+	unknownPoliciesPtr := flag.String("unknown-policies", "", "Write policy OIDs missing from the table to this CSV on exit, ready to add to the table")
+	unknownSizePtr := flag.Int("unknown-policies-size", 10000, "Policy OIDs missing from the table to track, later ones are only counted")
+	derPtr := flag.Bool("der", false, "Parse leaf_cert.as_der for subject, SANs, policies, key and validity, falling back to certstream's fields")
+	streamURLPtr := flag.String("stream-url", defaultStreamURL, "certstream websocket URL, e.g. a self-hosted certstream-server")
+	var streamHeaders stringList
+	flag.Var(&streamHeaders, "stream-header", "Extra \"Name: value\" header for the certstream connection, may be repeated")
+	streamTokenPtr := flag.String("stream-token", "", "Bearer token sent as the Authorization header to the certstream server")
+	streamCAPtr := flag.String("stream-ca", "", "PEM CA bundle to trust for the certstream server")
+	streamProxyPtr := flag.String("stream-proxy", "", "Proxy URL for the certstream connection, defaults to the environment's")
+	streamMaxBackoffPtr := flag.Duration("stream-max-backoff", 5*time.Minute, "Longest wait between certstream reconnect attempts")
+	streamHeartbeatPtr := flag.Duration("stream-heartbeat", 90*time.Second, "Alert and reconnect if certstream, having sent a heartbeat, sends none for this long, 0 to disable")
+	validationPtr := flag.String("validation", "", "Validation levels to filter, comma separated from dv, iv, ov, ev and unknown")
+	var issuers stringList
+	flag.Var(&issuers, "issuer", "Issuing CA name, organisation or fingerprint to filter, may be repeated")
+	var cpsFilters, noticeFilters stringList
+	flag.Var(&cpsFilters, "cps", "Substring of a policy's CPS URI to filter, may be repeated")
+	flag.Var(&noticeFilters, "notice", "Substring of a policy's User Notice explicit text to filter, may be repeated")
+	unusualCPSPtr := flag.Bool("unusual-cps", false, "Only match certificates with a CPS outside the known public CAs' domains")
+	cpsDomainsPtr := flag.String("cps-domains", "", "File of extra registrable domains, one per line, to treat as known CPS hosts")
+	var ctLogURLs stringList
+	flag.Var(&ctLogURLs, "ct-log", "Poll this RFC 6962 CT log directly instead of certstream, may be repeated")
+	ctLogFilePtr := flag.String("ct-log-file", "", "File of CT logs to poll, one per line as [name<TAB>]url")
+	ctCheckpointPtr := flag.String("ct-checkpoint", "ct-checkpoint.json", "File recording the next index to fetch from each polled CT or tiled log")
+	ctPollPtr := flag.Duration("ct-poll", 10*time.Second, "How often to poll CT logs and tiled logs for new entries")
+	ctBatchPtr := flag.Int("ct-batch", 256, "Entries to request per CT log get-entries call")
+	var tiledLogValues stringList
+	flag.Var(&tiledLogValues, "tiled-log", "Follow this Static CT API log, as url[,base64 public key], over HTTP or from a local directory, may be repeated")
+	tiledLogFilePtr := flag.String("tiled-log-file", "", "File of Static CT API logs to follow, one per line as [name<TAB>]url[,base64 public key]")
+	replayPtr := flag.String("replay", "", "Replay recorded certstream JSON lines from a file, or - for stdin, instead of the live stream")
+	recordPtr := flag.String("record", "", "Directory to archive raw stream messages to as rotating compressed JSON lines")
+	recordMatchedPtr := flag.Bool("record-matched", false, "Only archive messages that match the filters")
+	recordCompressPtr := flag.String("record-compress", "gzip", "Compression for archives: gzip, zstd or none")
+	recordSizePtr := flag.Int64("record-max-mb", 100, "Rotate archives after this many megabytes, 0 to disable")
+	recordIntervalPtr := flag.Duration("record-interval", time.Hour, "Rotate archives after this long, 0 to disable")
+	deadLetterPtr := flag.String("dead-letter", "", "Append messages that fail to decode or parse to this file as JSON lines, with the reason")
+	errorIntervalPtr := flag.Duration("error-interval", 5*time.Minute, "How often to log error counts by category and field, 0 to disable")
+	outputPtr := flag.String("output", outputTable, "How to report matches: table at exit, or jsonl or csv records as they arrive")
+	outPtr := flag.String("out", "", "File to write -output to, stdout if empty")
+	metricsPtr := flag.String("metrics", "", "Address to serve Prometheus metrics on at /metrics, such as :9102")
+	brandsPtr := flag.String("brands", "", "File of protected domains, one per line, to match lookalikes of")
+	brandScorePtr := flag.Float64("brand-score", 0.75, "Least similarity, from 0 to 1, for a name to match -brands")
+	var webhooks stringList
+	flag.Var(&webhooks, "webhook", "URL to POST matches to, may be repeated")
+	webhookTemplatePtr := flag.String("webhook-template", "json", "Webhook body: json, text for Slack, Mattermost or Teams, or a Go template file")
+	webhookSecretPtr := flag.String("webhook-secret", "", "Secret to sign webhook bodies with HMAC SHA-256")
+	webhookBatchPtr := flag.Duration("webhook-batch", 0, "Send the matches in each interval as one webhook, 0 to send each as it arrives")
+	webhookRetriesPtr := flag.Int("webhook-retries", 8, "Times to retry a failed webhook before dropping it")
+	webhookBackoffPtr := flag.Duration("webhook-backoff", time.Second, "Wait before the first webhook retry, doubling each time up to 5m")
+	webhookQueuePtr := flag.String("webhook-queue", "", "Directory to queue unsent webhooks in, so they survive restarts")
+	webhookQueueSizePtr := flag.Int("webhook-queue-size", 1000, "Webhooks to queue per URL before dropping the oldest")
+	storePtr := flag.String("store", "", "bbolt database to write matches to as they arrive, for the query subcommand")
+	dedupSizePtr := flag.Int("dedup-size", 100000, "Certificates to remember when merging duplicates and precerts into one row, 0 to keep every match")
+	replaySpeedPtr := flag.Float64("replay-speed", 0, "Replay timing relative to data.seen, 1 for the original pace, 0 for as fast as possible")
 
 	// args
 	flag.Parse()
 
+	if *pslPtr != "" {
+		list, err := loadSuffixList(*pslPtr)
+		if err != nil {
+			log.Fatalf("Failed to load public suffix list: %v", err)
+		}
+		publicSuffixes = list
+		log.Printf("Using public suffix list %q", *pslPtr)
+	}
+
+	unknownPoliciesFile = *unknownPoliciesPtr
+	maxUnknownPolicies = *unknownSizePtr
+
+	if *deadLetterPtr != "" {
+		letters, err := openDeadLetters(*deadLetterPtr)
+		if err != nil {
+			log.Fatalf("Failed to open dead letter file: %v", err)
+		}
+		deadLetters = letters
+		log.Printf("Writing failed messages to %q", *deadLetterPtr)
+	}
+
+	if *cpsDomainsPtr != "" {
+		if err := loadCPSDomains(*cpsDomainsPtr); err != nil {
+			log.Fatalf("Failed to load CPS domains: %v", err)
+		}
+		log.Printf("Using CPS domains from %q", *cpsDomainsPtr)
+	}
+
+	if *policiesPtr != "" {
+		if err := loadPolicyFile(*policiesPtr); err != nil {
+			log.Fatalf("Failed to load policies: %v", err)
+		}
+		log.Printf("Using policies from %q", *policiesPtr)
+	}
+
+	watch, err := newWatchlist(filters, regexes, *filterFilePtr)
+	if err != nil {
+		log.Fatalf("Failed to load filters: %v", err)
+	}
+
 	if !*hosePtr {
-		log.Printf("Using filter %q", *filterPtr)
+		log.Printf("Using %d filter patterns", watch.size())
+
+		// list them if there's only a handful
+		if watch.size() <= 10 {
+			for _, p := range append(watch.substrings, watch.regexes...) {
+				log.Printf("Using filter %q (%s)", p.term, p.label)
+			}
+		}
 	} else {
 		log.Printf("Outputting unfiltered stream")
 	}
 
+	var brands *brandList
+	if *brandsPtr != "" {
+		brands, err = loadBrands(*brandsPtr, *brandScorePtr)
+		if err != nil {
+			log.Fatalf("Failed to load brands: %v", err)
+		}
+		log.Printf("Watching for lookalikes of %d brands", len(brands.brands))
+	}
+
 	if *tldPtr != "" {
 		log.Printf("Using TLD filter %q", *tldPtr)
 	}
 
-	log.Println("Drinking from the hosepipe...")
+	if len(registrables) > 0 {
+		log.Printf("Using registrable domain filter %q", registrables.String())
+	}
+
+	if len(issuers) > 0 {
+		log.Printf("Using issuer filter %q", issuers.String())
+	}
+
+	levels, err := parseValidationLevels(*validationPtr)
+	if err != nil {
+		log.Fatalf("Failed to parse validation filter: %v", err)
+	}
+
+	if len(levels) > 0 {
+		log.Printf("Using validation filter %q", *validationPtr)
+	}
+
+	if *metricsPtr != "" {
+		if err := serveMetrics(*metricsPtr); err != nil {
+			log.Fatalf("Failed to serve metrics: %v", err)
+		}
+		log.Printf("Serving metrics on %q", *metricsPtr)
+	}
+
+	if *recordPtr != "" {
+		if *recordMatchedPtr && *hosePtr {
+			log.Fatalf("-record-matched can't be used with -hose, which matches nothing")
+		}
+
+		archive, err = newRecorder(*recordPtr, *recordCompressPtr, *recordSizePtr*1024*1024, *recordIntervalPtr)
+		if err != nil {
+			log.Fatalf("Failed to start recording: %v", err)
+		}
+		log.Printf("Recording to directory %q", *recordPtr)
+	}
+
+	if *outputPtr == outputTable {
+		if *outPtr != "" && *outPtr != "-" {
+			file, err := os.Create(*outPtr)
+			if err != nil {
+				log.Fatalf("Failed to open output: %v", err)
+			}
+			reports = file
+		}
+	} else {
+		matches, err = openMatchSink(*outputPtr, *outPtr)
+		if err != nil {
+			log.Fatalf("Failed to open output: %v", err)
+		}
+
+		// keep stdout to the records
+		if *outPtr == "" || *outPtr == "-" {
+			reports = os.Stderr
+		}
+		log.Printf("Writing %s matches to %q", *outputPtr, *outPtr)
+	}
+
+	if len(webhooks) > 0 {
+		alerts, err = newWebhookSink(webhooks, webhookOptions{
+			template:  *webhookTemplatePtr,
+			secret:    *webhookSecretPtr,
+			batch:     *webhookBatchPtr,
+			retries:   *webhookRetriesPtr,
+			backoff:   *webhookBackoffPtr,
+			queueDir:  *webhookQueuePtr,
+			queueSize: *webhookQueueSizePtr,
+			timeout:   10 * time.Second,
+		})
+		if err != nil {
+			log.Fatalf("Failed to start webhooks: %v", err)
+		}
+		log.Printf("Sending matches to %d webhooks", len(webhooks))
+	}
+
+	if *storePtr != "" {
+		store, err = openCertStore(*storePtr)
+		if err != nil {
+			log.Fatalf("Failed to open store: %v", err)
+		}
+		log.Printf("Storing matches in %q", *storePtr)
+	}
+
+	var stream chan *certstreamMessage
+	var errStream chan error
+
+	if *replayPtr != "" {
+		input, err := openReplayInput(*replayPtr)
+		if err != nil {
+			log.Fatalf("Failed to open replay: %v", err)
+		}
+
+		log.Printf("Replaying from %q", *replayPtr)
+		stream, errStream = replayStream(input, *replayPtr, *replaySpeedPtr)
+	} else if len(ctLogURLs) > 0 || *ctLogFilePtr != "" {
+		logs, err := loadCTLogs(ctLogURLs, *ctLogFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load CT logs: %v", err)
+		}
+
+		checkpoint, err := loadCTCheckpoint(*ctCheckpointPtr)
+		if err != nil {
+			log.Fatalf("Failed to load CT checkpoint: %v", err)
+		}
+
+		log.Printf("Polling %d CT logs directly", len(logs))
+		stream, errStream = ctLogStream(logs, checkpoint, *ctPollPtr, *ctBatchPtr)
+	} else if len(tiledLogValues) > 0 || *tiledLogFilePtr != "" {
+		logs, err := loadTiledLogs(tiledLogValues, *tiledLogFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load tiled logs: %v", err)
+		}
 
-	// The false flag specifies that we want heartbeat messages.
-	stream, errStream := certstream.CertStreamEventStream(false)
+		checkpoint, err := loadCTCheckpoint(*ctCheckpointPtr)
+		if err != nil {
+			log.Fatalf("Failed to load CT checkpoint: %v", err)
+		}
+
+		for _, tl := range logs {
+			if tl.key == nil {
+				log.Printf("No key for tiled log %q, checkpoints will not be verified", tl.url)
+			}
+		}
+
+		log.Printf("Following %d tiled CT logs", len(logs))
+		stream, errStream = tiledLogStream(logs, checkpoint, *ctPollPtr)
+	} else {
+		headers, err := parseStreamHeaders(streamHeaders, *streamTokenPtr)
+		if err != nil {
+			log.Fatalf("Failed to set up stream: %v", err)
+		}
 
-	// catch exit so we can print stats
-	c := make(chan os.Signal)
+		log.Println("Drinking from the hosepipe...")
+
+		// heartbeat messages are passed through
+		stream, errStream, err = websocketStream(streamOptions{
+			url:        *streamURLPtr,
+			headers:    headers,
+			caBundle:   *streamCAPtr,
+			proxy:      *streamProxyPtr,
+			minBackoff: time.Second,
+			maxBackoff: *streamMaxBackoffPtr,
+			heartbeat:  *streamHeartbeatPtr,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up stream: %v", err)
+		}
+	}
+
+	// catch exit so we can print stats, handled in the main loop as the
+	// stats and tables are only safe to read from there
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
-	go func() {
-		<-c
-		log.Printf("Caught CTL-C. Cleaning up and exiting\n")
-		elapsed := time.Since(start)
-		log.Printf("Ran for %s", elapsed.String())
+	// merge matches seen before, from another log or as a precert, through
+	// the store if there is one so nothing is held in memory per match
+	merge := *dedupSizePtr > 0
+	var seenCerts *certDedup
+	if merge && store == nil {
+		seenCerts = newCertDedup(*dedupSizePtr)
+	}
 
-		printFinalStats()
-		os.Exit(1)
-	}()
+	// log the error counts now and then, never if the interval is 0
+	var errorLog <-chan time.Time
+	if *errorIntervalPtr > 0 {
+		errorLog = time.NewTicker(*errorIntervalPtr).C
+	}
 
-	// kickoff timer, run indefinitely
+	// kickoff timer, run until the stream ends
 	start = time.Now()
 
 	for {
 		select {
-		case jq := <-stream:
-			countCertsSeen++
+		case message, ok := <-stream:
+			// replays end, the live stream doesn't
+			if !ok {
+				log.Printf("Stream finished. Cleaning up and exiting\n")
+				finish(0)
+			}
+			observeMessage(message)
+
+			// archive every message, heartbeats too, before it's parsed
+			if archive != nil && !*recordMatchedPtr {
+				recordMessage(message)
+			}
+
+			// only certificate updates carry certificates
+			switch message.MessageType {
+			case typeUpdate:
+				countCertsSeen++
+			case typeHeartbeat:
+				countHeartbeats++
+				continue
+			case typeDNSEntries:
+				countDNSEntries++
+				continue
+			default:
+				countOtherMessages++
+				continue
+			}
+
+			// note which fields are present, and any policies the table is missing
+			trackCompleteness(message)
+			trackUnknownPolicies(message)
+
+			// parse the certificate itself if asked, nil falls back to the JSON
+			var leaf *x509.Certificate
+			if *derPtr {
+				if parsed, err := parseLeafDER(message); err != nil {
+					noteError(errorDER, err, message.rawJSON())
+				} else {
+					leaf = parsed
+				}
+			}
 
-			// get common name only, to check filters
-			cn, err := getCNFromJSON(jq)
+			// get the names on the cert only, to check filters
+			domains, err := getDomains(message, leaf)
 
 			if err == nil {
 
@@ -90,107 +464,487 @@ func main() {
 				if *hosePtr {
 
 					// get certificate details
-					details, err := getCertDetailsFromJSON(jq)
+					details, err := getCertDetails(message, leaf)
 
 					// print if processed properly
 					if err == nil {
-						log.Printf("Type: %q, Subject: %q, Aggregated: %q, Validation: %q, Fingerprint: %q", details.updateType, details.commonName, details.aggregatedName, details.validation, details.fingerprint)
+						log.Printf("Type: %q, Subject: %q, Aggregated: %q, Domains: %q, Level: %q, Validation: %q, Issuer: %q, Issuing Org: %q, Issuer Fingerprint: %q, Issuer DN: %q, Fingerprint: %q", details.updateType, details.commonName, details.aggregatedName, strings.Join(details.allDomains, ", "), details.level, details.validation, details.issuingCA, details.issuingOrg, details.issuerFingerprint, details.issuerName, details.fingerprint)
+						logDERMismatch(details)
+						writeMatch(details, message, false)
 					} else {
-						countErrors++
+						noteError(errorDetails, err, message.rawJSON())
 					}
 				} else {
-					// else in filtered mode, check CN matches filter(s)
-					if (*filterPtr == "" || strings.Contains(cn, *filterPtr)) && (*tldPtr == "" || strings.HasSuffix(cn, *tldPtr)) {
-
-						details, err := getCertDetailsFromJSON(jq)
-
-						// print if processed properly
-						if err == nil {
-							log.Printf("Type: %q, Subject: %q, Aggregated: %q, Validation: %q", details.updateType, details.commonName, details.aggregatedName, details.validation)
-							certificates = append(certificates, details)
-						} else {
-							countErrors++
+					// else in filtered mode, check any name on the cert matches filter(s)
+					if matched, label, squat, ok := matchDomains(domains, watch, brands, *tldPtr, registrables); ok {
+
+						details, err := getCertDetails(message, leaf)
+
+						// print if processed properly, and from a CA, level and CPS we're watching
+						if err == nil && matchIssuer(details, issuers) && (len(levels) == 0 || levels[details.level]) && matchPolicyQualifiers(details, cpsFilters, noticeFilters, *unusualCPSPtr) {
+							if archive != nil && *recordMatchedPtr {
+								recordMessage(message)
+							}
+
+							details.matchedDomain = matched
+							details.matchedPattern = label
+							details.squatBrand = squat.brand
+							details.squatTechnique = squat.technique
+							details.squatScore = squat.score
+							details.publicSuffix = publicSuffixes.publicSuffix(matched)
+							details.registrable = publicSuffixes.registrableDomain(matched)
+							details.seen = message.seen()
+							if details.seen.IsZero() {
+								details.seen = time.Now()
+							}
+
+							if merge && store != nil {
+								if existing, ok, err := store.find(details); err != nil {
+									log.Printf("Error finding match in store: %q", err)
+								} else if ok {
+									countDuplicates++
+									merged := mergeDuplicate(existing, details)
+									storeMatch(merged)
+									writeMatch(merged, message, true)
+									log.Printf("Duplicate of match %q: %q, Type: %q, Log: %q", existing.fingerprint, details.commonName, details.updateType, strings.Join(details.logs, ", "))
+									continue
+								}
+							} else if seenCerts != nil {
+								if row, ok := seenCerts.find(details); ok {
+									countDuplicates++
+									certificates[row] = mergeDuplicate(certificates[row], details)
+									seenCerts.add(details, row)
+									storeMatch(certificates[row])
+									writeMatch(certificates[row], message, true)
+									log.Printf("Duplicate of match %d: %q, Type: %q, Log: %q", row, details.commonName, details.updateType, strings.Join(details.logs, ", "))
+									continue
+								}
+								seenCerts.add(details, len(certificates))
+							}
+
+							log.Printf("Type: %q, Subject: %q, Matched: %q, Pattern: %q, Aggregated: %q, Domains: %q, Level: %q, Validation: %q, Issuer: %q, Issuing Org: %q, Issuer Fingerprint: %q, Issuer DN: %q", details.updateType, details.commonName, details.matchedDomain, details.matchedPattern, details.aggregatedName, strings.Join(details.allDomains, ", "), details.level, details.validation, details.issuingCA, details.issuingOrg, details.issuerFingerprint, details.issuerName)
+							if details.squatBrand != "" {
+								log.Printf("Lookalike of %q: %q, Technique: %q, Score: %.2f", details.squatBrand, details.matchedDomain, details.squatTechnique, details.squatScore)
+							}
+							logDERMismatch(details)
+							noteCPSHosts(details)
+							storeMatch(details)
+							writeMatch(details, message, false)
+							if alerts != nil {
+								alerts.add(newMatchRecord(details, message, false))
+							}
+							metricMatches.WithLabelValues(details.matchedPattern).Inc()
+							if store == nil {
+								certificates = append(certificates, details)
+							}
+						} else if err != nil {
+							noteError(errorDetails, err, message.rawJSON())
 						}
 					}
 				}
 			} else {
-				//log.Printf("Error in processing: %q", err)
-				countErrors++
+				noteError(errorDomains, err, message.rawJSON())
 			}
 
 		case err := <-errStream:
 			log.Printf("Error in stream: %q", err)
-			countErrors++
+			noteStreamError(err)
+
+			// keep messages that wouldn't decode in the archive as well
+			var decodeErr *decodeError
+			if archive != nil && !*recordMatchedPtr && errors.As(err, &decodeErr) {
+				if err := archive.recordRaw(decodeErr.raw); err != nil {
+					log.Printf("Error recording message: %q", err)
+				}
+			}
+
+		case <-errorLog:
+			logErrorCounts()
+
+		case <-c:
+			log.Printf("Caught CTL-C. Cleaning up and exiting\n")
+			finish(1)
 		}
 	}
 }
 
-// Take a jq response, return just the CommonName from the Cert
-func getCNFromJSON(jq jsonq.JsonQuery) (string, error) {
+// Take a message and the parsed leaf, if any, return every DNS name on the Cert
+func getDomains(message *certstreamMessage, leaf *x509.Certificate) ([]string, error) {
+	if leaf != nil {
+		if domains := domainsFromDER(leaf); len(domains) > 0 {
+			return domains, nil
+		}
+	}
 
-	// get the CN from the map
-	cn, err := jq.String("data", "leaf_cert", "subject", "CN")
+	cert, err := message.leaf()
+	if err != nil {
+		return nil, err
+	}
 
-	// if we've no errors, stick the values in the struct
-	if err == nil {
-		return cn, nil
-	} else {
-		// else return the struct and an error
-		return "", fmt.Errorf("JSON Processing Failed")
+	domains := getDomainsFromJSON(cert)
+	if len(domains) == 0 {
+		return nil, &fieldError{"data.leaf_cert.subject.CN", "is missing, and there are no other names"}
+	}
+
+	return domains, nil
+}
+
+// Take a leaf_cert, return every DNS name on the Cert.
+// Uses all_domains where certstream provides it, falling back to the
+// subjectAltName extension and finally the CommonName.
+func getDomainsFromJSON(cert *certstreamCert) []string {
+
+	// all_domains already holds the CN and every SAN
+	if len(cert.AllDomains) > 0 {
+		return cert.AllDomains
+	}
+
+	// else pull the DNS entries out of the rendered extension
+	if cert.Extensions.SubjectAltName != nil {
+		if domains := parseSubjectAltName(*cert.Extensions.SubjectAltName); len(domains) > 0 {
+			return domains
+		}
+	}
+
+	// last resort, the CN on its own
+	if cert.Subject.CN != "" {
+		return []string{cert.Subject.CN}
+	}
+
+	return nil
+}
+
+// Take a rendered subjectAltName string such as "DNS:a.com, DNS:b.com",
+// return just the DNS names
+func parseSubjectAltName(sans string) []string {
+	var domains []string
+
+	for _, entry := range strings.Split(sans, ",") {
+		entry = strings.TrimSpace(entry)
+		if strings.HasPrefix(entry, "DNS:") {
+			domains = append(domains, entry[4:])
+		}
+	}
+
+	return domains
+}
+
+// Check each domain against the watchlist, TLD and registrable domains, return
+// the first that matches along with the label of the pattern that hit
+func matchDomains(domains []string, watch *watchlist, brands *brandList, tld string, registrables []string) (string, string, squatMatch, bool) {
+	for _, domain := range domains {
+		if tld != "" && !suffixUnder(publicSuffixes.publicSuffix(domain), tld) {
+			continue
+		}
+
+		if len(registrables) > 0 && !containsDomain(registrables, publicSuffixes.registrableDomain(domain)) {
+			continue
+		}
+
+		// with only brands to watch, names must look like one
+		if watch.size() > 0 || brands == nil {
+			if label, ok := watch.match(domain); ok {
+				return domain, label, squatMatch{}, true
+			}
+		}
+
+		if brands != nil {
+			if squat, ok := brands.match(domain); ok {
+				return domain, squat.brand, squat, true
+			}
+		}
+	}
+
+	return "", "", squatMatch{}, false
+}
+
+// Check whether a registrable domain is in the list, ignoring case
+func containsDomain(list []string, domain string) bool {
+	for _, entry := range list {
+		if domain != "" && strings.EqualFold(entry, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Take a message and the parsed leaf, if any, return the details with the
+// certificate's own fields taking precedence over certstream's rendering
+func getCertDetails(message *certstreamMessage, leaf *x509.Certificate) (certDetails, error) {
+	details, err := getCertDetailsFromJSON(message)
+	if leaf == nil {
+		return details, err
+	}
+
+	// the DER can stand in for broken JSON, as long as we know the update type
+	compare := err == nil
+	if err != nil {
+		if message.Data.UpdateType == "" {
+			return details, err
+		}
+		details = certDetails{
+			updateType: message.Data.UpdateType,
+			logs:       []string{messageLog(message)},
+			seenAs:     []string{message.Data.UpdateType},
+		}
+	}
+
+	policies := ""
+	if cert := message.Data.LeafCert; cert != nil && cert.Extensions.CertificatePolicies != nil {
+		policies = *cert.Extensions.CertificatePolicies
 	}
+	applyDERDetails(&details, leaf, policies, compare)
+
+	details.publicSuffix = publicSuffixes.publicSuffix(details.commonName)
+	details.registrable = publicSuffixes.registrableDomain(details.commonName)
+
+	return details, nil
 }
 
-// Take a jq response, parse out the details we care about
-func getCertDetailsFromJSON(jq jsonq.JsonQuery) (certDetails, error) {
+// Log any fields where certstream's rendering disagreed with the DER
+func logDERMismatch(details certDetails) {
+	if len(details.derMismatch) > 0 {
+		log.Printf("DER disagrees with certstream on %s for %q", strings.Join(details.derMismatch, ", "), details.fingerprint)
+	}
+}
+
+// Take a message, parse out the details we care about. Null subject fields
+// are left blank, missing required fields are named in the error.
+func getCertDetailsFromJSON(message *certstreamMessage) (certDetails, error) {
 	var details certDetails
 
-	// get the details from the map, in a clunky fashion
-	updateType, err := jq.String("data", "update_type")
-	commonName, err2 := jq.String("data", "leaf_cert", "subject", "CN")
-	aggregated, err3 := jq.String("data", "leaf_cert", "subject", "aggregated")
-	fingerprint, err4 := jq.String("data", "leaf_cert", "fingerprint")
-	policies, err5 := jq.String("data", "leaf_cert", "extensions", "certificatePolicies")
-
-	// if we've no errors, stick the values in the struct
-	if err == nil && err2 == nil && err3 == nil && err4 == nil && err5 == nil {
-		details.commonName = commonName
-		details.updateType = updateType
-		details.aggregatedName = aggregated
-		details.fingerprint = fingerprint
-		details.validation = GetCertValidationType(policies)
-	} else {
-		// else return the struct and an error
-		return details, fmt.Errorf("JSON Processing Failed")
+	cert, err := message.leaf()
+	if err != nil {
+		return details, err
 	}
 
+	if message.Data.UpdateType == "" {
+		return details, &fieldError{"data.update_type", "is missing"}
+	}
+
+	if cert.Fingerprint == "" {
+		return details, &fieldError{"data.leaf_cert.fingerprint", "is missing"}
+	}
+
+	details.commonName = cert.Subject.CN
+	details.updateType = message.Data.UpdateType
+	details.aggregatedName = cert.Subject.Aggregated
+	details.fingerprint = cert.Fingerprint
+	details.serialNumber = cert.SerialNumber
+	details.precert = message.Data.UpdateType == "PrecertLogEntry"
+	details.logs = []string{messageLog(message)}
+	details.seenAs = []string{message.Data.UpdateType}
+
+	// policies are optional, without them the validation is "None"
+	policies := ""
+	if cert.Extensions.CertificatePolicies != nil {
+		policies = *cert.Extensions.CertificatePolicies
+	}
+	setValidation(&details, policies)
+
+	details.allDomains = getDomainsFromJSON(cert)
+	getIssuerFromJSON(message, &details)
+	details.notBefore = unixTime(cert.NotBefore)
+	details.notAfter = unixTime(cert.NotAfter)
+	details.publicSuffix = publicSuffixes.publicSuffix(details.commonName)
+	details.registrable = publicSuffixes.registrableDomain(details.commonName)
+
 	return details, nil
 }
 
+// Classify the rendered policies into the details, "None" if there are none
+func setValidation(details *certDetails, policies string) {
+	validation := ClassifyCertValidation(policies)
+
+	details.validation = strings.Join(validation.Names, ", ")
+	if details.validation == "" {
+		details.validation = "None"
+	}
+	details.level = validation.Level
+	details.policyNames = validation.Names
+	details.policyIDs = validation.OIDs
+	details.certPolicies = validation.Policies
+	details.unusualCPS = unusualCPSHosts(validation.Policies)
+}
+
+// Print how long we ran and the stats, then exit
+func finish(code int) {
+	elapsed := time.Since(start)
+	log.Printf("Ran for %s", elapsed.String())
+
+	if archive != nil {
+		if err := archive.Close(); err != nil {
+			log.Printf("Error closing archive: %q", err)
+		}
+	}
+
+	// the final table comes from the store, if it holds the matches
+	if store != nil {
+		stored, err := store.runMatches()
+		if err != nil {
+			log.Printf("Error reading matches from store: %q", err)
+		}
+		certificates = stored
+
+		if err := store.Close(); err != nil {
+			log.Printf("Error closing store: %q", err)
+		}
+	}
+
+	if alerts != nil {
+		alerts.Close(10 * time.Second)
+	}
+
+	if matches != nil {
+		if err := matches.Close(); err != nil {
+			log.Printf("Error closing output: %q", err)
+		}
+	}
+
+	if deadLetters != nil {
+		if err := deadLetters.Close(); err != nil {
+			log.Printf("Error closing dead letter file: %q", err)
+		}
+	}
+
+	printFinalStats()
+
+	if unknownPoliciesFile != "" {
+		if err := writeUnknownPolicies(unknownPoliciesFile); err != nil {
+			log.Printf("Error writing unknown policies: %q", err)
+		} else {
+			log.Printf("Wrote %d unknown policies to %q", len(unknownPolicies), unknownPoliciesFile)
+		}
+	}
+
+	os.Exit(code)
+}
+
+// Write a match to the store, if there is one, logging rather than
+// stopping on failure
+func storeMatch(details certDetails) {
+	if store == nil {
+		return
+	}
+
+	if err := store.put(details); err != nil {
+		log.Printf("Error storing match: %q", err)
+	}
+}
+
+// Write a match record, if -output asks for them, logging rather than
+// stopping on failure
+func writeMatch(details certDetails, message *certstreamMessage, duplicate bool) {
+	if matches == nil {
+		return
+	}
+
+	if err := matches.write(details, message, duplicate); err != nil {
+		log.Printf("Error writing match: %q", err)
+	}
+}
+
+// Archive a raw message, logging rather than stopping on failure
+func recordMessage(message *certstreamMessage) {
+	if err := archive.record(message); err != nil {
+		log.Printf("Error recording message: %q", err)
+	}
+}
+
 // Print stats then exit
 func printFinalStats() {
 	log.Println("Final stats:")
 	log.Printf("Certificates seen: %d", countCertsSeen)
+	log.Printf("Heartbeats: %d", countHeartbeats)
+	log.Printf("DNS entries: %d", countDNSEntries)
+	log.Printf("Other messages: %d", countOtherMessages)
 	//log.Printf("Updates: %d", countUpdates)
 	log.Printf("Matched: %d", len(certificates))
+	log.Printf("Duplicates merged: %d", countDuplicates)
+	if countUnknownOverflowed > 0 {
+		log.Printf("Unknown policies past -unknown-policies-size: %d", countUnknownOverflowed)
+	}
 	log.Printf("Error in processing: %d\n", countErrors)
 
 	// print all saved certs
 	writer := new(tabwriter.Writer)
 
 	// Format in tab-separated columns with a tab stop of 8, padding of 4.
-	writer.Init(os.Stdout, 0, 8, 4, '\t', 0)
-	fmt.Fprintln(writer, "\nCount\tSubject\tAggregated\tUpdate Type\tValidation\tFingerprint")
+	writer.Init(reports, 0, 8, 4, '\t', 0)
+	printMatches(writer, certificates)
+
+	// what went wrong
+	if countErrors > 0 {
+		printErrorCounts(writer)
+		writer.Flush()
+	}
+
+	// how much of the stream had each field
+	if countLeafCerts > 0 {
+		printCompleteness(writer)
+		writer.Flush()
+	}
+
+	// where the matches' CAs publish their CPS
+	if len(cpsHostCounts) > 0 {
+		printCPSHosts(writer)
+		writer.Flush()
+	}
+
+	// policies to add to the table
+	if len(unknownPolicies) > 0 {
+		printUnknownPolicies(writer)
+		writer.Flush()
+	}
+}
+
+// Print the matches table, then the matches grouped by registrable domain
+func printMatches(writer *tabwriter.Writer, certificates []certDetails) {
+	fmt.Fprintln(writer, "\nCount\tSubject\tMatched\tPattern\tRegistrable\tSuffix\tAggregated\tUpdate Type\tLevel\tValidation\tIssuing CA\tIssuing Org\tIssuer Fingerprint\tIssuer DN\tRoot CA\tFingerprint\tKey\tNot After\tDER Mismatch\tUnusual CPS\tLookalike\tSeen As\tLogs\tDomains")
 
 	for i, cert := range certificates {
-		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\t%s\n", i, cert.commonName, cert.aggregatedName, cert.updateType, cert.validation, cert.fingerprint)
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i, cert.commonName, cert.matchedDomain, cert.matchedPattern, cert.registrable, cert.publicSuffix, cert.aggregatedName, cert.updateType, cert.level, cert.validation, cert.issuingCA, cert.issuingOrg, cert.issuerFingerprint, cert.issuerName, cert.rootCA, cert.fingerprint, keyColumn(cert), formatValidity(cert.notAfter), strings.Join(cert.derMismatch, ", "), strings.Join(cert.unusualCPS, ", "), squatColumn(cert), strings.Join(cert.seenAs, ", "), strings.Join(cert.logs, ", "), strings.Join(cert.allDomains, ", "))
+	}
+
+	writer.Flush()
+
+	// group the matches by organisation domain
+	byDomain := map[string]int{}
+	var order []string
+	for _, cert := range certificates {
+		if _, ok := byDomain[cert.registrable]; !ok {
+			order = append(order, cert.registrable)
+		}
+		byDomain[cert.registrable]++
+	}
+
+	fmt.Fprintln(writer, "\nRegistrable Domain\tMatches")
+	for _, domain := range order {
+		fmt.Fprintf(writer, "%s\t%d\n", domain, byDomain[domain])
 	}
 
 	writer.Flush()
 }
 
+// Key algorithm and size for the table, blank unless parsed from the DER
+func keyColumn(cert certDetails) string {
+	if cert.keyAlgorithm == "" {
+		return ""
+	}
+	if cert.keySize == 0 {
+		return cert.keyAlgorithm
+	}
+	return fmt.Sprintf("%s %d", cert.keyAlgorithm, cert.keySize)
+}
+
 // helper function prints the structure
-func printStructure(jq jsonq.JsonQuery) {
-	dataMap, _ := jq.Object("data")
+func printStructure(message *certstreamMessage) {
+	var raw struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	json.Unmarshal(message.rawJSON(), &raw)
+	dataMap := raw.Data
 
 	for key, value := range dataMap {
 		switch t := value.(type) {
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// output formats for -output
+const (
+	outputTable = "table"
+	outputJSONL = "jsonl"
+	outputCSV   = "csv"
+)
+
+// matchRecord is a match as written by -output, every certDetails field
+// plus when and from which log it arrived
+type matchRecord struct {
+	Time      time.Time `json:"time"`
+	Log       string    `json:"log"`
+	Duplicate bool      `json:"duplicate"`
+	storedCert
+	FromDER     bool         `json:"from_der"`
+	PolicyNames []string     `json:"policy_names"`
+	PolicyIDs   []string     `json:"policy_ids"`
+	Policies    []CertPolicy `json:"policies"`
+}
+
+// CSV columns, in the same order as the JSON fields
+var matchColumns = []string{
+	"time", "log", "duplicate", "common_name", "aggregated", "matched_domain", "matched_pattern", "registrable", "public_suffix",
+	"update_type", "level", "validation", "issuing_ca", "issuing_org", "issuer_fingerprint", "issuer_name", "root_ca", "fingerprint", "serial_number",
+	"precert_fingerprint", "precert", "key_algorithm", "key_size", "not_before", "not_after", "der_mismatch", "unusual_cps",
+	"lookalike", "lookalike_technique", "lookalike_score", "seen_as", "logs",
+	"domains", "seen", "from_der", "policy_names", "policy_ids", "policies",
+}
+
+// matchSink writes each match as it arrives, as JSON lines or CSV
+type matchSink struct {
+	format string
+	file   io.WriteCloser
+	csv    *csv.Writer
+}
+
+// Open the sink, writing to stdout if path is empty or "-"
+func openMatchSink(format string, path string) (*matchSink, error) {
+	if format != outputJSONL && format != outputCSV {
+		return nil, fmt.Errorf("unknown output %q, use jsonl, csv or table", format)
+	}
+
+	sink := &matchSink{format: format, file: os.Stdout}
+	if path != "" && path != "-" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		sink.file = file
+	}
+
+	if format == outputCSV {
+		sink.csv = csv.NewWriter(sink.file)
+
+		// appending to a CSV that already has its header
+		if file, ok := sink.file.(*os.File); ok {
+			if info, err := file.Stat(); err == nil && info.Mode().IsRegular() && info.Size() > 0 {
+				return sink, nil
+			}
+		}
+
+		if err := sink.csv.Write(matchColumns); err != nil {
+			return nil, err
+		}
+		sink.csv.Flush()
+	}
+
+	return sink, nil
+}
+
+// The record for a match, or a duplicate merged into an earlier one, which
+// arrived in message
+func newMatchRecord(details certDetails, message *certstreamMessage, duplicate bool) matchRecord {
+	return matchRecord{
+		Time:        time.Now().UTC(),
+		Log:         messageLog(message),
+		Duplicate:   duplicate,
+		storedCert:  toStoredCert(details),
+		FromDER:     details.fromDER,
+		PolicyNames: details.policyNames,
+		PolicyIDs:   details.policyIDs,
+		Policies:    details.certPolicies,
+	}
+}
+
+// Write a match, or a duplicate merged into an earlier one, which
+// arrived in message
+func (s *matchSink) write(details certDetails, message *certstreamMessage, duplicate bool) error {
+	record := newMatchRecord(details, message, duplicate)
+
+	if s.format == outputJSONL {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = s.file.Write(append(line, '\n'))
+		return err
+	}
+
+	s.csv.Write(csvRow(record))
+	s.csv.Flush()
+	return s.csv.Error()
+}
+
+// A record as CSV, lists joined with "; " and times as RFC 3339
+func csvRow(r matchRecord) []string {
+	var policies []string
+	for _, policy := range r.Policies {
+		policies = append(policies, policy.OID+" "+policy.Name)
+	}
+
+	return []string{
+		formatTime(r.Time), r.Log, strconv.FormatBool(r.Duplicate), r.CommonName, r.Aggregated, r.MatchedDomain, r.MatchedPattern, r.Registrable, r.PublicSuffix,
+		r.UpdateType, r.Level, r.Validation, r.IssuingCA, r.IssuingOrg, r.IssuerFingerprint, r.IssuerName, r.RootCA, r.Fingerprint, r.SerialNumber,
+		r.PrecertFingerprint, strconv.FormatBool(r.Precert), r.KeyAlgorithm, keySizeColumn(r.KeySize), formatTime(r.NotBefore), formatTime(r.NotAfter), joinList(r.DERMismatch), joinList(r.UnusualCPS),
+		r.Lookalike, r.LookalikeTechnique, scoreColumn(r.LookalikeScore), joinList(r.SeenAs), joinList(r.Logs),
+		joinList(r.Domains), formatTime(r.Seen), strconv.FormatBool(r.FromDER), joinList(r.PolicyNames), joinList(r.PolicyIDs), joinList(policies),
+	}
+}
+
+// blank unless parsed from the DER
+func keySizeColumn(size int) string {
+	if size == 0 {
+		return ""
+	}
+	return strconv.Itoa(size)
+}
+
+// blank unless matched by -brands
+func scoreColumn(score float64) string {
+	if score == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(score, 'f', 2, 64)
+}
+
+func joinList(list []string) string {
+	return strings.Join(list, "; ")
+}
+
+// RFC 3339 in UTC, blank for zero
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func (s *matchSink) Close() error {
+	if s.file == os.Stdout {
+		return nil
+	}
+	return s.file.Close()
+}
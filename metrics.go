@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, kept alongside the counters printed at exit, as those
+// are only safe to read from the main loop
+var (
+	metricMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "certificates_messages_total",
+		Help: "Stream messages received, by message_type.",
+	}, []string{"message_type"})
+
+	metricCertsSeen = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "certificates_certs_seen_total",
+		Help: "Certificate updates received.",
+	})
+
+	metricUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "certificates_updates_total",
+		Help: "Certificate updates received, by update_type.",
+	}, []string{"update_type"})
+
+	metricLogCerts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "certificates_log_certs_total",
+		Help: "Certificate updates received, by source CT log.",
+	}, []string{"log"})
+
+	metricIssuerCerts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "certificates_issuer_certs_total",
+		Help: "Certificate updates received, by issuing CA name.",
+	}, []string{"issuer"})
+
+	metricMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "certificates_matches_total",
+		Help: "Certificates matched, by the filter pattern that matched, not counting merged duplicates.",
+	}, []string{"pattern"})
+
+	metricErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "certificates_errors_total",
+		Help: "Errors in processing, by category.",
+	}, []string{"category"})
+
+	metricLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "certificates_stream_lag_seconds",
+		Help: "How long before the latest certificate update arrived certstream saw it.",
+	})
+
+	// unix nanoseconds of the last message, read when scraped
+	lastMessage atomic.Int64
+)
+
+// Listen on addr now, so a port in use fails at startup, then serve
+// /metrics in the background, logging rather than exiting if that stops
+func serveMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricMessages, metricCertsSeen, metricUpdates, metricLogCerts, metricIssuerCerts, metricMatches, metricErrors, metricLag,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "certificates_last_message_age_seconds",
+			Help: "Time since the last stream message, of any type, or since starting if there hasn't been one.",
+		}, func() float64 {
+			return time.Since(time.Unix(0, lastMessage.Load())).Seconds()
+		}),
+	)
+
+	lastMessage.Store(time.Now().UnixNano())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Metrics server failed: %q", err)
+		}
+	}()
+
+	return nil
+}
+
+// The message_type label for a message, with anything but the known types
+// counted as other so a misbehaving server can't add series without bound
+func messageTypeLabel(messageType string) string {
+	switch messageType {
+	case typeUpdate, typeHeartbeat, typeDNSEntries:
+		return messageType
+	default:
+		return "other"
+	}
+}
+
+// Count a message from the stream, and for a certificate update its type,
+// source log and issuer, and how far behind the stream it arrived
+func observeMessage(message *certstreamMessage) {
+	now := time.Now()
+	lastMessage.Store(now.UnixNano())
+
+	metricMessages.WithLabelValues(messageTypeLabel(message.MessageType)).Inc()
+	if message.MessageType != typeUpdate {
+		return
+	}
+
+	metricCertsSeen.Inc()
+	metricUpdates.WithLabelValues(message.Data.UpdateType).Inc()
+	metricLogCerts.WithLabelValues(messageLog(message)).Inc()
+
+	issuer := ""
+	if chain := message.Data.Chain; len(chain) > 0 {
+		issuer = chain[0].Subject.CN
+		if issuer == "" {
+			issuer = chain[0].Subject.O
+		}
+	}
+	metricIssuerCerts.WithLabelValues(issuer).Inc()
+
+	if seen := message.seen(); !seen.IsZero() {
+		metricLag.Set(now.Sub(seen).Seconds())
+	}
+}
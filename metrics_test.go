@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestMessageTypeLabel(t *testing.T) {
+	tests := []struct {
+		messageType string
+		want        string
+	}{
+		{typeUpdate, typeUpdate},
+		{typeHeartbeat, typeHeartbeat},
+		{typeDNSEntries, typeDNSEntries},
+		{"", "other"},
+		{"certificate_update2", "other"},
+		{"made_up_type", "other"},
+	}
+
+	for _, test := range tests {
+		if got := messageTypeLabel(test.messageType); got != test.want {
+			t.Errorf("messageTypeLabel(%q) = %q, want %q", test.messageType, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OID is an object identifier as its arcs, e.g. 2.23.140.1.2.1
+type OID []uint64
+
+// Parse a dotted decimal OID, rejecting leading zeros, empty arcs and
+// stray whitespace. The first arc must be 0, 1 or 2, and under 0 and 1
+// the second arc must be below 40, as X.660 requires.
+func parseOID(s string) (OID, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("OID %q needs at least two arcs", s)
+	}
+
+	oid := make(OID, len(parts))
+	for i, part := range parts {
+		if part == "" || (len(part) > 1 && part[0] == '0') || part[0] == '+' {
+			return nil, fmt.Errorf("OID %q has a malformed arc %q", s, part)
+		}
+
+		arc, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("OID %q has a malformed arc %q", s, part)
+		}
+		oid[i] = arc
+	}
+
+	if oid[0] > 2 {
+		return nil, fmt.Errorf("OID %q must start with 0, 1 or 2", s)
+	}
+
+	if oid[0] < 2 && oid[1] >= 40 {
+		return nil, fmt.Errorf("OID %q has a second arc over 39", s)
+	}
+
+	return oid, nil
+}
+
+func (o OID) String() string {
+	arcs := make([]string, len(o))
+	for i, arc := range o {
+		arcs[i] = strconv.FormatUint(arc, 10)
+	}
+	return strings.Join(arcs, ".")
+}
+
+// Parent drops the last arc, nil once only the root arcs are left
+func (o OID) Parent() OID {
+	if len(o) <= 2 {
+		return nil
+	}
+	return o[:len(o)-1]
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseOID(t *testing.T) {
+	tests := []struct {
+		oid  string
+		want string
+		ok   bool
+	}{
+		{"2.23.140.1.2.1", "2.23.140.1.2.1", true},
+		{"1.3.6.1.4.1.6449.1.2.1.5.1", "1.3.6.1.4.1.6449.1.2.1.5.1", true},
+		{"0.39", "0.39", true},
+		{"2.999.1", "2.999.1", true},
+		{"1.3.18446744073709551615", "1.3.18446744073709551615", true},
+
+		{"", "", false},
+		{"2", "", false},
+		{"2.23.", "", false},
+		{".2.23", "", false},
+		{"2..23", "", false},
+		{"2.023.140", "", false},
+		{"2.23.+140", "", false},
+		{"2.23.-140", "", false},
+		{" 2.23.140", "", false},
+		{"2.23.140 ", "", false},
+		{"2.23.1a", "", false},
+		{"1.3.18446744073709551616", "", false},
+		{"3.1", "", false},
+		{"0.40", "", false},
+		{"1.40.1", "", false},
+	}
+
+	for _, test := range tests {
+		oid, err := parseOID(test.oid)
+		if (err == nil) != test.ok {
+			t.Errorf("parseOID(%q) error = %v, want ok %v", test.oid, err, test.ok)
+		} else if test.ok && oid.String() != test.want {
+			t.Errorf("parseOID(%q) = %s, want %s", test.oid, oid, test.want)
+		}
+	}
+}
+
+func TestPolicyTableLookup(t *testing.T) {
+	table := &policyTable{names: map[string]string{}}
+	problems, err := table.load(strings.NewReader("OID,Name\n"+
+		"2.23.140.1.2.1,Domain Validated\n"+
+		"1.3.6.1.4.1.6449,Sectigo\n"+
+		"1.3.6.1.4.1.6449.1.2.1.5.1,Sectigo DV\n"+
+		"2.16,Joint ISO ITU-T Country\n"), "test.csv")
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("load = %v, %v", problems, err)
+	}
+
+	tests := []struct {
+		oid      string
+		name     string
+		inferred bool
+		ok       bool
+	}{
+		{"2.23.140.1.2.1", "Domain Validated", false, true},
+		{"1.3.6.1.4.1.6449.1.2.1.5.1", "Sectigo DV", false, true},
+		{"1.3.6.1.4.1.6449.1.2.1.5.1.7", "Sectigo DV", true, true},
+		{"1.3.6.1.4.1.6449.1.2.2.7", "Sectigo", true, true},
+		{"1.3.6.1.4.1.6449", "Sectigo", false, true},
+		{"2.16.840.1.114412", "Joint ISO ITU-T Country", true, true},
+
+		// whole arcs only, and nothing above the nearest entry
+		{"1.3.6.1.4.1.64490.1", "", false, false},
+		{"1.3.6.1.4.1", "", false, false},
+		{"2.23.140.1.2.2", "", false, false},
+		{"2.23.140.1.2", "", false, false},
+	}
+
+	for _, test := range tests {
+		oid, err := parseOID(test.oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name, inferred, ok := table.lookup(oid)
+		if name != test.name || inferred != test.inferred || ok != test.ok {
+			t.Errorf("lookup(%s) = %q, %v, %v, want %q, %v, %v", test.oid, name, inferred, ok, test.name, test.inferred, test.ok)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unknownPolicy records a policy OID missing from the table
+type unknownPolicy struct {
+	oid         string
+	count       int
+	firstSeen   time.Time
+	fingerprint string
+	issuingCA   string
+}
+
+// unknown OIDs seen this run, keyed on OID, up to -unknown-policies-size of
+// them. New OIDs past the limit are only counted, so a stream of junk OIDs
+// can't grow the map without bound.
+var (
+	unknownPolicies        = map[string]*unknownPolicy{}
+	maxUnknownPolicies     = 10000
+	countUnknownOverflowed int
+)
+
+// Take a message, record any policy OIDs the table doesn't know.
+// Runs on every certificate, matched or not, to keep the table current.
+func trackUnknownPolicies(message *certstreamMessage) {
+	leaf := message.Data.LeafCert
+	if leaf == nil || leaf.Extensions.CertificatePolicies == nil {
+		return
+	}
+
+	for _, entry := range strings.Split(*leaf.Extensions.CertificatePolicies, "\n") {
+		if !strings.HasPrefix(entry, "Policy: ") {
+			continue
+		}
+
+		oid := strings.TrimSpace(entry[8:])
+		if _, ok := policies.names[oid]; ok {
+			continue
+		}
+
+		if unknown, ok := unknownPolicies[oid]; ok {
+			unknown.count++
+			continue
+		}
+
+		if len(unknownPolicies) >= maxUnknownPolicies {
+			countUnknownOverflowed++
+			continue
+		}
+
+		unknown := &unknownPolicy{oid: oid, count: 1, firstSeen: time.Now(), fingerprint: leaf.Fingerprint}
+		if len(message.Data.Chain) > 0 {
+			unknown.issuingCA = message.Data.Chain[0].Subject.CN
+		}
+		unknownPolicies[oid] = unknown
+	}
+}
+
+// Unknown OIDs, most often seen first
+func sortedUnknownPolicies() []*unknownPolicy {
+	sorted := make([]*unknownPolicy, 0, len(unknownPolicies))
+	for _, unknown := range unknownPolicies {
+		sorted = append(sorted, unknown)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return sorted[i].oid < sorted[j].oid
+	})
+
+	return sorted
+}
+
+// Print the unknown OIDs as a table
+func printUnknownPolicies(w io.Writer) {
+	fmt.Fprintln(w, "\nUnknown Policy OID\tCount\tFirst Seen\tExample Fingerprint\tIssuing CA")
+
+	for _, unknown := range sortedUnknownPolicies() {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", unknown.oid, unknown.count, unknown.firstSeen.Format(time.RFC3339), unknown.fingerprint, unknown.issuingCA)
+	}
+}
+
+// Write the unknown OIDs as CSV in the policy table's format. The names are
+// left empty to fill in, the table won't load a row without one, and the
+// extra columns are ignored when the file is loaded with -policies.
+func writeUnknownPolicies(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"OID", "Name", "Count", "First Seen", "Example Fingerprint", "Issuing CA"})
+
+	for _, unknown := range sortedUnknownPolicies() {
+		writer.Write([]string{unknown.oid, "", strconv.Itoa(unknown.count), unknown.firstSeen.Format(time.RFC3339), unknown.fingerprint, unknown.issuingCA})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
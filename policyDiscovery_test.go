@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A certificate with the given rendered policies, issued by ca
+func testPolicyMessage(fingerprint string, ca string, policyOIDs ...string) *certstreamMessage {
+	var rendered []string
+	for _, oid := range policyOIDs {
+		rendered = append(rendered, "Policy: "+oid)
+	}
+	joined := strings.Join(rendered, "\n")
+
+	return &certstreamMessage{
+		MessageType: typeUpdate,
+		Data: messageData{
+			LeafCert: &certstreamCert{Fingerprint: fingerprint, Extensions: certExtensions{CertificatePolicies: &joined}},
+			Chain:    []certstreamCert{{Subject: certSubject{CN: ca}}},
+		},
+	}
+}
+
+// Reset the unknown policies for a test and put them back after
+func resetUnknownPolicies(t *testing.T, max int) {
+	saved, savedMax, savedOverflowed := unknownPolicies, maxUnknownPolicies, countUnknownOverflowed
+	unknownPolicies, maxUnknownPolicies, countUnknownOverflowed = map[string]*unknownPolicy{}, max, 0
+	t.Cleanup(func() {
+		unknownPolicies, maxUnknownPolicies, countUnknownOverflowed = saved, savedMax, savedOverflowed
+	})
+}
+
+func TestTrackUnknownPolicies(t *testing.T) {
+	resetUnknownPolicies(t, 2)
+
+	// the DV OID is in the table, the rest aren't
+	trackUnknownPolicies(testPolicyMessage("AA", "Example CA", "2.23.140.1.2.1", "1.3.6.1.4.1.99999.1"))
+	trackUnknownPolicies(testPolicyMessage("BB", "Other CA", "1.3.6.1.4.1.99999.1", "1.3.6.1.4.1.88888.1"))
+	trackUnknownPolicies(testPolicyMessage("CC", "Third CA", "1.3.6.1.4.1.77777.1", "1.3.6.1.4.1.66666.1"))
+
+	sorted := sortedUnknownPolicies()
+	if len(sorted) != 2 {
+		t.Fatalf("tracked %d unknown policies, want the limit of 2", len(sorted))
+	}
+	if first := sorted[0]; first.oid != "1.3.6.1.4.1.99999.1" || first.count != 2 || first.fingerprint != "AA" || first.issuingCA != "Example CA" {
+		t.Errorf("most seen = %+v, want 1.3.6.1.4.1.99999.1 twice, first from AA", *first)
+	}
+	if countUnknownOverflowed != 2 {
+		t.Errorf("overflowed %d, want 2", countUnknownOverflowed)
+	}
+}
+
+func TestWriteUnknownPolicies(t *testing.T) {
+	resetUnknownPolicies(t, 10)
+	trackUnknownPolicies(testPolicyMessage("AA", "Example CA", "1.3.6.1.4.1.99999.1"))
+
+	path := filepath.Join(t.TempDir(), "unknown.csv")
+	if err := writeUnknownPolicies(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || lines[0] != "OID,Name,Count,First Seen,Example Fingerprint,Issuing CA" {
+		t.Fatalf("wrote %q", lines)
+	}
+	if !strings.HasPrefix(lines[1], "1.3.6.1.4.1.99999.1,,1,") || !strings.HasSuffix(lines[1], ",AA,Example CA") {
+		t.Errorf("row %q, want an empty name and the CA last", lines[1])
+	}
+
+	// unfilled rows are refused rather than loaded under a made up name
+	table := &policyTable{names: map[string]string{}}
+	problems, err := table.load(strings.NewReader(string(data)), "unknown.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].reason != "has no name" || len(table.names) != 0 {
+		t.Errorf("loading the unfilled CSV gave problems %v and names %v", problems, table.names)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// snapshot of https://publicsuffix.org/list/public_suffix_list.dat
+//
+//go:embed public_suffix_list.dat
+var embeddedSuffixList string
+
+// kinds of Public Suffix List rule, as bits since a name can have both a
+// plain and a wildcard rule
+const (
+	ruleNormal = 1 << iota
+	ruleWildcard
+	ruleException
+)
+
+// suffixList holds the Public Suffix List rules, keyed on the rule text
+// without any "*." or "!" marker. A wildcard is kept on its parent, so
+// "*.ck" is a ruleWildcard on "ck", which doesn't make "ck" a rule itself.
+// IDN rules are kept as punycode, the form certificate names use.
+type suffixList struct {
+	rules map[string]int
+}
+
+// the list used for filtering, replaced by -psl
+var publicSuffixes = mustParseSuffixList(strings.NewReader(embeddedSuffixList))
+
+// Parse the embedded list, which is known to be good
+func mustParseSuffixList(r io.Reader) *suffixList {
+	list, err := parseSuffixList(r)
+	if err != nil {
+		panic(err)
+	}
+	return list
+}
+
+// Load a list from a local copy of public_suffix_list.dat
+func loadSuffixList(path string) (*suffixList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseSuffixList(file)
+}
+
+// Parse the list format, one rule per line, ignoring comments and blanks
+func parseSuffixList(r io.Reader) (*suffixList, error) {
+	list := &suffixList{rules: map[string]int{}}
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		// rules end at the first whitespace
+		line = strings.Fields(line)[0]
+		line = strings.ToLower(line)
+
+		key := strings.TrimPrefix(strings.TrimPrefix(line, "!"), "*.")
+		key, err := idna.ToASCII(key)
+		if err != nil {
+			return nil, fmt.Errorf("public suffix rule %q: %v", line, err)
+		}
+
+		switch {
+		case strings.HasPrefix(line, "!"):
+			list.rules[key] |= ruleException
+		case strings.HasPrefix(line, "*."):
+			list.rules[key] |= ruleWildcard
+		default:
+			list.rules[key] |= ruleNormal
+		}
+	}
+
+	return list, scanner.Err()
+}
+
+// Return the public suffix of a domain, e.g. "co.uk" for "www.example.co.uk".
+// A leading wildcard label on certificate names is ignored.
+func (l *suffixList) publicSuffix(domain string) string {
+	domain = normaliseDomain(domain)
+	if domain == "" {
+		return ""
+	}
+
+	labels := strings.Split(domain, ".")
+
+	// default rule "*", the last label
+	suffix := labels[len(labels)-1]
+
+	// walk from the longest candidate, the first hit is the longest match
+	for i := 0; i < len(labels); i++ {
+		candidate := strings.Join(labels[i:], ".")
+
+		kind := l.rules[candidate]
+		if kind&ruleException != 0 {
+			// exception rules make the parent the suffix
+			return strings.Join(labels[i+1:], ".")
+		}
+
+		if kind&ruleNormal != 0 {
+			return candidate
+		}
+
+		// a wildcard on the parent covers this label too
+		if i+1 < len(labels) && l.rules[strings.Join(labels[i+1:], ".")]&ruleWildcard != 0 {
+			return candidate
+		}
+	}
+
+	return suffix
+}
+
+// Return the registrable domain (eTLD+1), e.g. "example.co.uk" for
+// "www.example.co.uk", or "" if the domain is itself a public suffix
+func (l *suffixList) registrableDomain(domain string) string {
+	domain = normaliseDomain(domain)
+	suffix := l.publicSuffix(domain)
+
+	if suffix == "" || domain == suffix {
+		return ""
+	}
+
+	rest := strings.TrimSuffix(domain, "."+suffix)
+	if i := strings.LastIndex(rest, "."); i >= 0 {
+		rest = rest[i+1:]
+	}
+
+	return rest + "." + suffix
+}
+
+// Lower case a certificate name, strip any wildcard label and trailing dot,
+// and write Unicode labels as punycode to match the rules
+func normaliseDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, "*.")
+	domain = strings.TrimSuffix(domain, ".")
+
+	if ascii, err := idna.ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	return domain
+}
+
+// Check a public suffix sits under the TLD filter, so "uk" covers "co.uk"
+// but not "fuk"
+func suffixUnder(suffix string, tld string) bool {
+	tld = strings.Trim(strings.ToLower(tld), ".")
+	return suffix == tld || strings.HasSuffix(suffix, "."+tld)
+}
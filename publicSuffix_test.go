@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPublicSuffix(t *testing.T) {
+	tests := []struct {
+		domain      string
+		suffix      string
+		registrable string
+	}{
+		// plain rules
+		{"com", "com", ""},
+		{"a.b.example.com", "com", "example.com"},
+		{"uk", "uk", ""},
+		{"WWW.Example.CO.UK.", "co.uk", "example.co.uk"},
+		{"*.example.co.uk", "co.uk", "example.co.uk"},
+
+		// "*.ck" with "!www.ck"
+		{"ck", "ck", ""},
+		{"foo.ck", "foo.ck", ""},
+		{"a.foo.ck", "foo.ck", "a.foo.ck"},
+		{"www.ck", "ck", "www.ck"},
+		{"a.www.ck", "ck", "www.ck"},
+
+		// "*.kawasaki.jp" with "!city.kawasaki.jp", the wildcard not making
+		// kawasaki.jp a suffix itself
+		{"kawasaki.jp", "jp", "kawasaki.jp"},
+		{"a.kawasaki.jp", "a.kawasaki.jp", ""},
+		{"a.b.kawasaki.jp", "b.kawasaki.jp", "a.b.kawasaki.jp"},
+		{"city.kawasaki.jp", "kawasaki.jp", "city.kawasaki.jp"},
+		{"www.city.kawasaki.jp", "kawasaki.jp", "city.kawasaki.jp"},
+
+		// IDN rules match the punycode certificates carry, and Unicode names
+		// are converted to it
+		{"xn--55qx5d.cn", "xn--55qx5d.cn", ""},
+		{"example.xn--55qx5d.cn", "xn--55qx5d.cn", "example.xn--55qx5d.cn"},
+		{"www.example.xn--55qx5d.cn", "xn--55qx5d.cn", "example.xn--55qx5d.cn"},
+		{"example.公司.cn", "xn--55qx5d.cn", "example.xn--55qx5d.cn"},
+
+		// an unlisted TLD is a suffix on its own
+		{"example.unknowntld", "unknowntld", "example.unknowntld"},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		if suffix := publicSuffixes.publicSuffix(test.domain); suffix != test.suffix {
+			t.Errorf("publicSuffix(%q) = %q, want %q", test.domain, suffix, test.suffix)
+		}
+		if registrable := publicSuffixes.registrableDomain(test.domain); registrable != test.registrable {
+			t.Errorf("registrableDomain(%q) = %q, want %q", test.domain, registrable, test.registrable)
+		}
+	}
+}
+
+// A plain rule and a wildcard on the same name are both kept
+func TestParseSuffixList(t *testing.T) {
+	list, err := parseSuffixList(strings.NewReader("// comment\n\nbd\n*.bd\n!gov.bd\nfoo.bd extra words\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain string
+		suffix string
+	}{
+		{"bd", "bd"},
+		{"example.bd", "example.bd"},
+		{"a.example.bd", "example.bd"},
+		{"gov.bd", "bd"},
+		{"a.foo.bd", "foo.bd"},
+	}
+
+	for _, test := range tests {
+		if suffix := list.publicSuffix(test.domain); suffix != test.suffix {
+			t.Errorf("publicSuffix(%q) = %q, want %q", test.domain, suffix, test.suffix)
+		}
+	}
+}
+
+func TestSuffixUnder(t *testing.T) {
+	tests := []struct {
+		suffix string
+		tld    string
+		want   bool
+	}{
+		{"co.uk", "uk", true},
+		{"uk", "uk", true},
+		{"co.uk", ".UK.", true},
+		{"fuk", "uk", false},
+		{"uk", "co.uk", false},
+	}
+
+	for _, test := range tests {
+		if got := suffixUnder(test.suffix, test.tld); got != test.want {
+			t.Errorf("suffixUnder(%q, %q) = %v, want %v", test.suffix, test.tld, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// name of the index file written alongside the archives
+const recordIndexName = "index.jsonl"
+
+// recorder archives raw stream messages to rotating, compressed JSON lines
+// files in a directory. Each file gets an open line in index.jsonl when it's
+// created, replaced when it's closed by a line per source log giving the
+// cert_index range it holds. A file still marked open after a crash may be
+// truncated.
+type recorder struct {
+	mu          sync.Mutex
+	dir         string
+	compression string
+	maxBytes    int64
+	interval    time.Duration
+
+	file       *os.File
+	counter    *countingWriter
+	compressor io.WriteCloser
+	fileName   string
+	opened     time.Time
+	ranges     map[string]*indexRange
+}
+
+// indexRange is one line of index.jsonl
+type indexRange struct {
+	File       string `json:"file"`
+	Open       bool   `json:"open,omitempty"`
+	Source     string `json:"source"`
+	FirstIndex int64  `json:"first_index"`
+	LastIndex  int64  `json:"last_index"`
+	Count      int    `json:"count"`
+	FirstSeen  string `json:"first_seen"`
+	LastSeen   string `json:"last_seen"`
+}
+
+// countingWriter tracks how many compressed bytes have hit the file
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// Create a recorder, rotating when the file passes maxBytes or is older than
+// interval. Either can be zero to disable it.
+func newRecorder(dir string, compression string, maxBytes int64, interval time.Duration) (*recorder, error) {
+	if compression != "gzip" && compression != "zstd" && compression != "none" {
+		return nil, fmt.Errorf("unknown compression %q, use gzip, zstd or none", compression)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &recorder{
+		dir:         dir,
+		compression: compression,
+		maxBytes:    maxBytes,
+		interval:    interval,
+	}, nil
+}
+
+// Write one message, rotating first if the current file is full or old
+func (r *recorder) record(message *certstreamMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.write(message.rawJSON()); err != nil {
+		return err
+	}
+
+	r.track(message)
+
+	return nil
+}
+
+// Write a raw message that couldn't be decoded, so the archive holds the
+// stream as it arrived. It has no source log to index.
+func (r *recorder) recordRaw(raw []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.write(raw)
+}
+
+// Write one line to the current file, opening or rotating it as needed
+func (r *recorder) write(raw []byte) error {
+	// rotate, the next file is opened below
+	if r.file != nil && r.due() {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+	}
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.compressor.Write(raw); err != nil {
+		return err
+	}
+	_, err := r.compressor.Write([]byte{'\n'})
+
+	return err
+}
+
+// Check whether the current file has hit its size or age limit
+func (r *recorder) due() bool {
+	if r.maxBytes > 0 && r.counter.count >= r.maxBytes {
+		return true
+	}
+
+	return r.interval > 0 && time.Since(r.opened) >= r.interval
+}
+
+// Open a new archive named for the current time
+func (r *recorder) open() error {
+	r.opened = time.Now()
+	r.fileName = "certstream-" + r.opened.UTC().Format("20060102T150405.000") + ".jsonl"
+
+	switch r.compression {
+	case "gzip":
+		r.fileName += ".gz"
+	case "zstd":
+		r.fileName += ".zst"
+	}
+
+	file, err := os.OpenFile(filepath.Join(r.dir, r.fileName), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	r.file = file
+	r.counter = &countingWriter{w: file}
+	r.ranges = map[string]*indexRange{}
+
+	switch r.compression {
+	case "gzip":
+		r.compressor = gzip.NewWriter(r.counter)
+	case "zstd":
+		encoder, err := zstd.NewWriter(r.counter)
+		if err != nil {
+			file.Close()
+			r.file = nil
+			return err
+		}
+		r.compressor = encoder
+	default:
+		r.compressor = nopWriteCloser{r.counter}
+	}
+
+	log.Printf("Recording to %q", filepath.Join(r.dir, r.fileName))
+
+	return r.appendIndex(indexRange{File: r.fileName, Open: true})
+}
+
+// nopWriteCloser is the compressor when recording uncompressed
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Extend the cert_index range of the message's source log
+func (r *recorder) track(message *certstreamMessage) {
+	source := message.Data.Source.URL
+	if source == "" {
+		return
+	}
+
+	index := message.Data.CertIndex
+
+	seen := ""
+	if seenAt := message.seen(); !seenAt.IsZero() {
+		seen = seenAt.UTC().Format(time.RFC3339)
+	}
+
+	entry, ok := r.ranges[source]
+	if !ok {
+		r.ranges[source] = &indexRange{
+			File:       r.fileName,
+			Source:     source,
+			FirstIndex: index,
+			LastIndex:  index,
+			Count:      1,
+			FirstSeen:  seen,
+			LastSeen:   seen,
+		}
+		return
+	}
+
+	if index < entry.FirstIndex {
+		entry.FirstIndex = index
+	}
+	if index > entry.LastIndex {
+		entry.LastIndex = index
+	}
+	if seen != "" {
+		if entry.FirstSeen == "" {
+			entry.FirstSeen = seen
+		}
+		entry.LastSeen = seen
+	}
+	entry.Count++
+}
+
+// Flush and close the current file, then append its ranges to the index
+func (r *recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.compressor.Close()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+
+	if err != nil {
+		return err
+	}
+
+	return r.writeIndex()
+}
+
+// Append a line to index.jsonl
+func (r *recorder) appendIndex(entry indexRange) error {
+	index, err := os.OpenFile(filepath.Join(r.dir, recordIndexName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(index).Encode(entry); err != nil {
+		index.Close()
+		return err
+	}
+
+	return index.Close()
+}
+
+// Replace the current file's lines in index.jsonl with one per source log,
+// or a single empty range if it held nothing from a log
+func (r *recorder) writeIndex() error {
+	path := filepath.Join(r.dir, recordIndexName)
+
+	// keep every other file's lines as they are
+	var lines bytes.Buffer
+	if existing, err := os.ReadFile(path); err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(existing))
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			var entry indexRange
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.File == r.fileName {
+				continue
+			}
+			lines.Write(scanner.Bytes())
+			lines.WriteByte('\n')
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	sources := make([]string, 0, len(r.ranges))
+	for source := range r.ranges {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	encoder := json.NewEncoder(&lines)
+	if len(sources) == 0 {
+		if err := encoder.Encode(indexRange{File: r.fileName}); err != nil {
+			return err
+		}
+	}
+	for _, source := range sources {
+		if err := encoder.Encode(r.ranges[source]); err != nil {
+			return err
+		}
+	}
+
+	// swap the new index in whole so a crash can't leave half of it
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, lines.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(temp, path)
+}
+
+// Close the recorder, flushing the last file
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.closeFile()
+}
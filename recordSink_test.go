@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Read every line of index.jsonl
+func readRecordIndex(t *testing.T, dir string) []indexRange {
+	t.Helper()
+
+	file, err := os.Open(filepath.Join(dir, recordIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var entries []indexRange
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry indexRange
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("index line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// A certificate update from a log, seen at the given Unix time
+func testRecordMessage(source string, index int64, seen float64) *certstreamMessage {
+	return &certstreamMessage{
+		MessageType: typeUpdate,
+		Data: messageData{
+			UpdateType: "X509LogEntry",
+			CertIndex:  index,
+			Seen:       seen,
+			Source:     messageSource{URL: source},
+		},
+	}
+}
+
+func TestRecorderIndex(t *testing.T) {
+	for _, compression := range []string{"gzip", "zstd", "none"} {
+		t.Run(compression, func(t *testing.T) {
+			dir := t.TempDir()
+			archive, err := newRecorder(dir, compression, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages := []*certstreamMessage{
+				testRecordMessage("https://b.example/", 7, 1584546695),
+				{MessageType: typeHeartbeat, raw: []byte(`{"message_type":"heartbeat"}`)},
+				testRecordMessage("https://a.example/", 3, 1584546696),
+				testRecordMessage("https://a.example/", 1, 1584546697),
+			}
+			for _, message := range messages {
+				if err := archive.record(message); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := archive.recordRaw([]byte(`{"message_type": `)); err != nil {
+				t.Fatal(err)
+			}
+
+			// the file is in the index as soon as it's opened
+			open := readRecordIndex(t, dir)
+			if len(open) != 1 || !open[0].Open || open[0].File != archive.fileName {
+				t.Errorf("index while open %+v, want one open line for %s", open, archive.fileName)
+			}
+
+			if err := archive.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			closed := readRecordIndex(t, dir)
+			want := []indexRange{
+				{File: archive.fileName, Source: "https://a.example/", FirstIndex: 1, LastIndex: 3, Count: 2, FirstSeen: "2020-03-18T15:51:36Z", LastSeen: "2020-03-18T15:51:37Z"},
+				{File: archive.fileName, Source: "https://b.example/", FirstIndex: 7, LastIndex: 7, Count: 1, FirstSeen: "2020-03-18T15:51:35Z", LastSeen: "2020-03-18T15:51:35Z"},
+			}
+			if len(closed) != len(want) {
+				t.Fatalf("index after close %+v, want %+v", closed, want)
+			}
+			for i := range want {
+				if closed[i] != want[i] {
+					t.Errorf("index line %d = %+v, want %+v", i, closed[i], want[i])
+				}
+			}
+
+			// every message comes back in order, heartbeat and broken line included
+			path := filepath.Join(dir, archive.fileName)
+			replayed, errs := replayAll(t, path, 0)
+			if len(replayed) != 4 || replayed[1].MessageType != typeHeartbeat || replayed[3].Data.CertIndex != 1 {
+				t.Errorf("replayed %d messages, want the 4 recorded", len(replayed))
+			}
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), ":5:") {
+				t.Errorf("replay errors %v, want the broken line 5", errs)
+			}
+		})
+	}
+}
+
+func TestRecorderRotation(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := newRecorder(dir, "none", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one byte fills a file, so each message gets its own
+	var files []string
+	for i := int64(0); i < 3; i++ {
+		if err := archive.record(testRecordMessage("https://a.example/", i, 1584546695)); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, archive.fileName)
+
+		// keep the names, which have millisecond resolution, apart
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readRecordIndex(t, dir)
+	if len(entries) != 3 {
+		t.Fatalf("index %+v, want a line per file", entries)
+	}
+	for i, entry := range entries {
+		if entry.Open || entry.File != files[i] || entry.FirstIndex != int64(i) || entry.Count != 1 {
+			t.Errorf("index line %d = %+v, want the closed range of %s", i, entry, files[i])
+		}
+	}
+}
+
+func TestRecorderNothingIndexed(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := newRecorder(dir, "gzip", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := archive.record(&certstreamMessage{MessageType: typeHeartbeat}); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file of heartbeats is still listed, and no longer open
+	entries := readRecordIndex(t, dir)
+	if len(entries) != 1 || entries[0].Open || entries[0].File != archive.fileName || entries[0].Count != 0 {
+		t.Errorf("index %+v, want one empty closed line", entries)
+	}
+}
+
+func TestNewRecorderCompression(t *testing.T) {
+	if _, err := newRecorder(t.TempDir(), "bzip2", 0, 0); err == nil {
+		t.Errorf("accepted bzip2")
+	}
+}
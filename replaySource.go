@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// replayStream reads recorded certstream messages, one JSON object per line,
+// from input as opened by openReplayInput, and feeds them down the same
+// channels as the live stream. Errors are reported against path.
+//
+// A speed of 0 replays as fast as possible; otherwise the gaps between each
+// message's data.seen are slept, divided by speed, so 1 is the original timing.
+// The stream channel is closed once the input is exhausted.
+func replayStream(input io.ReadCloser, path string, speed float64) (chan *certstreamMessage, chan error) {
+	stream := make(chan *certstreamMessage)
+	errStream := make(chan error)
+
+	go func() {
+		defer close(stream)
+		defer input.Close()
+
+		reader := bufio.NewReader(input)
+		lineNumber := 0
+		lastSeen := 0.0
+
+		for {
+			line, err := reader.ReadBytes('\n')
+			lineNumber++
+
+			if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+				if message, decodeErr := decodeMessage(trimmed); decodeErr != nil {
+					errStream <- fmt.Errorf("%s:%d: %w", path, lineNumber, decodeErr)
+				} else {
+
+					// sleep out the gap to the previous message
+					if seen := message.Data.Seen; speed > 0 && seen > 0 {
+						if lastSeen > 0 && seen > lastSeen {
+							time.Sleep(time.Duration((seen - lastSeen) / speed * float64(time.Second)))
+						}
+						lastSeen = seen
+					}
+
+					stream <- message
+				}
+			}
+
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				errStream <- err
+				return
+			}
+		}
+	}()
+
+	return stream, errStream
+}
+
+// replayInput closes both the decompressor and the underlying file
+type replayInput struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *replayInput) Close() error {
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		r.closers[i].Close()
+	}
+	return nil
+}
+
+// Open the replay file, or stdin for "-", unwrapping gzip or zstd, such as
+// -record archives, as detected from their magic bytes
+func openReplayInput(path string) (io.ReadCloser, error) {
+	input := &replayInput{}
+
+	if path == "-" {
+		input.Reader = os.Stdin
+	} else {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		input.Reader = file
+		input.closers = append(input.closers, file)
+	}
+
+	// peek for the gzip or zstd magic numbers
+	buffered := bufio.NewReader(input.Reader)
+	input.Reader = buffered
+
+	magic, _ := buffered.Peek(4)
+	if len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			input.Close()
+			return nil, err
+		}
+		input.Reader = gz
+		input.closers = append(input.closers, gz)
+	} else if bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			input.Close()
+			return nil, err
+		}
+		input.Reader = zr
+		input.closers = append(input.closers, zr.IOReadCloser())
+	}
+
+	return input, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Three recorded messages seen 0.4s apart, with a blank line between
+func testRecording() []byte {
+	var lines bytes.Buffer
+	for i, name := range []string{"zero.example.com", "one.example.com", "two.example.com"} {
+		fmt.Fprintf(&lines, `{"message_type":"certificate_update","data":{"update_type":"X509LogEntry","cert_index":%d,"seen":%v,"leaf_cert":{"subject":{"CN":%q}}}}`+"\n", i, 1584546695+0.4*float64(i), name)
+		if i == 0 {
+			lines.WriteString("\n")
+		}
+	}
+	return lines.Bytes()
+}
+
+// Replay a file to the end, returning the messages and errors in order
+func replayAll(t *testing.T, path string, speed float64) ([]*certstreamMessage, []error) {
+	t.Helper()
+
+	input, err := openReplayInput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, errStream := replayStream(input, path, speed)
+
+	var messages []*certstreamMessage
+	var errs []error
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message, ok := <-stream:
+			if !ok {
+				return messages, errs
+			}
+			messages = append(messages, message)
+		case err := <-errStream:
+			errs = append(errs, err)
+		case <-timeout:
+			t.Fatalf("replay of %s didn't finish", path)
+		}
+	}
+}
+
+func TestReplayFormats(t *testing.T) {
+	recording := testRecording()
+
+	var gz bytes.Buffer
+	gzWriter := gzip.NewWriter(&gz)
+	gzWriter.Write(recording)
+	gzWriter.Close()
+
+	var zst bytes.Buffer
+	zstWriter, err := zstd.NewWriter(&zst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstWriter.Write(recording)
+	zstWriter.Close()
+
+	// named without extensions, so only the magic bytes tell them apart
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"plain", recording},
+		{"gzip", gz.Bytes()},
+		{"zstd", zst.Bytes()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "recording")
+			if err := os.WriteFile(path, test.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			messages, errs := replayAll(t, path, 0)
+			if len(errs) > 0 {
+				t.Errorf("errors %v", errs)
+			}
+			if len(messages) != 3 {
+				t.Fatalf("%d messages, want 3", len(messages))
+			}
+			for i, message := range messages {
+				if message.Data.CertIndex != int64(i) {
+					t.Errorf("message %d is entry %d", i, message.Data.CertIndex)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayBadLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	data := append([]byte("{\"message_type\": \"heartbeat\"}\n{\"message_type\": \n"), testRecording()...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, errs := replayAll(t, path, 0)
+	if len(messages) != 4 || messages[0].MessageType != "heartbeat" {
+		t.Errorf("%d messages, want the heartbeat and three certificates", len(messages))
+	}
+	if len(errs) != 1 || !bytes.Contains([]byte(errs[0].Error()), []byte("recording.jsonl:2:")) {
+		t.Errorf("errors %v, want one on line 2", errs)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	if err := os.WriteFile(path, testRecording(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 0.8s of recording at four times the pace, then as fast as possible
+	started := time.Now()
+	replayAll(t, path, 4)
+	if elapsed := time.Since(started); elapsed < 190*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("speed 4 took %s, want about 200ms", elapsed)
+	}
+
+	started = time.Now()
+	replayAll(t, path, 0)
+	if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+		t.Errorf("speed 0 took %s", elapsed)
+	}
+}
+
+func TestOpenReplayInputMissing(t *testing.T) {
+	if _, err := openReplayInput(filepath.Join(t.TempDir(), "missing.jsonl")); err == nil {
+		t.Errorf("opened a missing file")
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entries per full data tile, see https://c2sp.org/static-ct-api
+const tileWidth = 256
+
+// note signature types, see https://c2sp.org/signed-note
+const (
+	noteSigEd25519 = 0x01
+	noteSigRFC6962 = 0x05
+)
+
+// tiledLog is one Static CT API log, read over HTTP or from a local directory
+type tiledLog struct {
+	name   string
+	url    string // the prefix without its scheme, as certstream names logs
+	prefix string
+	key    crypto.PublicKey
+	rawKey []byte
+}
+
+// Build the log list from -tiled-log values of url[,key] and an optional
+// file of [name<TAB>]url[,key] lines. Keys are base64 DER public keys.
+func loadTiledLogs(values []string, path string) ([]tiledLog, error) {
+	var logs []tiledLog
+
+	for _, value := range values {
+		tl, err := parseTiledLog("", value)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, tl)
+	}
+
+	if path == "" {
+		return logs, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value := "", line
+		if i := strings.Index(line, "\t"); i >= 0 {
+			name = strings.TrimSpace(line[:i])
+			value = strings.TrimSpace(line[i+1:])
+		}
+
+		tl, err := parseTiledLog(name, value)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, tl)
+	}
+
+	return logs, scanner.Err()
+}
+
+// Split a url[,key] value
+func parseTiledLog(name string, value string) (tiledLog, error) {
+	url, key := value, ""
+	if i := strings.Index(value, ","); i >= 0 {
+		url, key = value[:i], value[i+1:]
+	}
+
+	return newTiledLog(name, url, key)
+}
+
+// Normalise the log prefix and parse its key, if given
+func newTiledLog(name string, url string, key string) (tiledLog, error) {
+	url = strings.TrimSuffix(url, "/")
+
+	origin := url
+	if i := strings.Index(origin, "://"); i >= 0 {
+		origin = origin[i+3:]
+	}
+
+	if name == "" {
+		name = origin
+	}
+
+	tl := tiledLog{name: name, url: origin, prefix: url}
+
+	if key == "" {
+		return tl, nil
+	}
+
+	der, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return tl, fmt.Errorf("%s: bad key: %v", url, err)
+	}
+
+	tl.key, err = x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return tl, fmt.Errorf("%s: bad key: %v", url, err)
+	}
+	tl.rawKey = der
+
+	return tl, nil
+}
+
+// tiledPoller walks data tiles from each log's saved position
+type tiledPoller struct {
+	client     *http.Client
+	checkpoint *ctCheckpoint
+	poll       time.Duration
+
+	mu      sync.Mutex
+	issuers map[string]*x509.Certificate
+}
+
+// tiledLogStream follows Static CT API logs, verifying each checkpoint and
+// decoding the data tiles into certstream shaped messages on the same
+// channels as the live stream. Positions are kept in the same checkpoint
+// file as -ct-log, and logs without one start from their current head.
+func tiledLogStream(logs []tiledLog, checkpoint *ctCheckpoint, poll time.Duration) (chan *certstreamMessage, chan error) {
+	stream := make(chan *certstreamMessage)
+	errStream := make(chan error)
+
+	poller := &tiledPoller{
+		client:     &http.Client{Timeout: 30 * time.Second},
+		checkpoint: checkpoint,
+		poll:       poll,
+		issuers:    map[string]*x509.Certificate{},
+	}
+
+	for _, tl := range logs {
+		go poller.run(tl, stream, errStream)
+	}
+
+	return stream, errStream
+}
+
+// Follow one log forever
+func (p *tiledPoller) run(tl tiledLog, stream chan *certstreamMessage, errStream chan error) {
+	next, started := p.checkpoint.get(tl.url)
+
+	for {
+		size, err := p.fetchCheckpoint(tl)
+		if err != nil {
+			errStream <- err
+			time.Sleep(p.poll)
+			continue
+		}
+
+		if !started {
+			next, started = size, true
+			if err := p.checkpoint.set(tl.url, next); err != nil {
+				errStream <- err
+			}
+		}
+
+		for next < size {
+			tile := next / tileWidth
+			width := int64(tileWidth)
+			if (tile+1)*tileWidth > size {
+				width = size - tile*tileWidth
+			}
+
+			entries, err := p.fetchDataTile(tl, tile, width)
+			if err != nil {
+				errStream <- err
+				break
+			}
+
+			if int64(len(entries)) < width {
+				errStream <- fmt.Errorf("%s tile %d: %d of %d entries", tl.url, tile, len(entries), width)
+			}
+
+			// skip entries already seen in a partial tile, and stop at the
+			// first that failed to fetch so it is retried on the next poll
+			link := tl.prefix + "/" + dataTilePath(tile, width)
+			for next < tile*tileWidth+int64(len(entries)) {
+				message, err := p.buildMessage(tl, next, link, entries[next-tile*tileWidth])
+				if err != nil {
+					errStream <- fmt.Errorf("%s entry %d: %v", tl.url, next, err)
+					if _, retry := err.(fetchError); retry {
+						break
+					}
+				} else {
+					stream <- message
+				}
+				next++
+			}
+
+			if err := p.checkpoint.set(tl.url, next); err != nil {
+				errStream <- err
+			}
+
+			if next < tile*tileWidth+width {
+				break
+			}
+		}
+
+		time.Sleep(p.poll)
+	}
+}
+
+// Read a path under the log prefix, over HTTP or from a local directory
+func (p *tiledPoller) fetch(tl tiledLog, path string) ([]byte, error) {
+	if !strings.HasPrefix(tl.prefix, "http://") && !strings.HasPrefix(tl.prefix, "https://") {
+		return os.ReadFile(filepath.Join(tl.prefix, filepath.FromSlash(path)))
+	}
+
+	response, err := p.client.Get(tl.prefix + "/" + path)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s/%s: %s", tl.prefix, path, response.Status)
+	}
+
+	return io.ReadAll(response.Body)
+}
+
+// Fetch the checkpoint, verify its signature if we have the log's key, and
+// return the tree size
+func (p *tiledPoller) fetchCheckpoint(tl tiledLog) (int64, error) {
+	note, err := p.fetch(tl, "checkpoint")
+	if err != nil {
+		return 0, err
+	}
+
+	// body and signatures are split by a blank line
+	split := bytes.Index(note, []byte("\n\n"))
+	if split < 0 {
+		return 0, fmt.Errorf("%s: malformed checkpoint", tl.url)
+	}
+	text, signatures := note[:split+1], note[split+2:]
+
+	lines := strings.Split(string(text), "\n")
+	if len(lines) < 4 {
+		return 0, fmt.Errorf("%s: malformed checkpoint", tl.url)
+	}
+
+	origin := lines[0]
+	size, err := strconv.ParseInt(lines[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: malformed checkpoint size: %v", tl.url, err)
+	}
+
+	rootHash, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(rootHash) != sha256.Size {
+		return 0, fmt.Errorf("%s: malformed checkpoint root hash", tl.url)
+	}
+
+	if tl.key == nil {
+		return size, nil
+	}
+
+	// the key ID binds the origin, so a local mirror can live at any path
+	if err := verifyCheckpoint(tl, origin, text, string(signatures), size, rootHash); err != nil {
+		return 0, fmt.Errorf("%s: %v", tl.url, err)
+	}
+
+	return size, nil
+}
+
+// Check the note carries a valid signature from the log's key, either an
+// RFC 6962 tree head signature or a plain Ed25519 note signature
+func verifyCheckpoint(tl tiledLog, origin string, text []byte, signatures string, size int64, rootHash []byte) error {
+	for _, line := range strings.Split(signatures, "\n") {
+		if !strings.HasPrefix(line, "— ") {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, "— "))
+		if len(fields) != 2 || fields[0] != origin {
+			continue
+		}
+
+		sig, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(sig) < 4 {
+			continue
+		}
+
+		if edKey, ok := tl.key.(ed25519.PublicKey); ok {
+			if bytes.Equal(sig[:4], noteKeyID(origin, noteSigEd25519, edKey)) && ed25519.Verify(edKey, text, sig[4:]) {
+				return nil
+			}
+			continue
+		}
+
+		// RFC6962NoteSignature key IDs hash the log ID, not the key itself
+		logID := sha256.Sum256(tl.rawKey)
+		if bytes.Equal(sig[:4], noteKeyID(origin, noteSigRFC6962, logID[:])) && verifyTreeHead(tl.key, sig[4:], size, rootHash) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no valid checkpoint signature for the configured key")
+}
+
+// The first four bytes of SHA-256(name || "\n" || type || key), where key
+// is the Ed25519 public key or, for RFC 6962 signatures, the log ID
+func noteKeyID(name string, sigType byte, key []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(name + "\n"))
+	h.Write([]byte{sigType})
+	h.Write(key)
+	return h.Sum(nil)[:4]
+}
+
+// Verify an RFC6962NoteSignature, a timestamp and TLS DigitallySigned over the
+// RFC 6962 TreeHeadSignature for this size and root hash
+func verifyTreeHead(key crypto.PublicKey, sig []byte, size int64, rootHash []byte) bool {
+	if len(sig) < 12 {
+		return false
+	}
+
+	timestamp := sig[:8]
+	length := int(binary.BigEndian.Uint16(sig[10:12]))
+	if len(sig) < 12+length {
+		return false
+	}
+	signature := sig[12 : 12+length]
+
+	// version v1, signature type tree_hash
+	signed := []byte{0, 1}
+	signed = append(signed, timestamp...)
+	signed = binary.BigEndian.AppendUint64(signed, uint64(size))
+	signed = append(signed, rootHash...)
+	digest := sha256.Sum256(signed)
+
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(pub, digest[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	}
+
+	return false
+}
+
+// The tile path for an index, e.g. tile/data/x001/x234/067, with .p/<width>
+// for a partial tile
+func dataTilePath(tile int64, width int64) string {
+	digits := fmt.Sprintf("%03d", tile)
+	for len(digits)%3 != 0 {
+		digits = "0" + digits
+	}
+
+	var parts []string
+	for i := 0; i < len(digits); i += 3 {
+		parts = append(parts, "x"+digits[i:i+3])
+	}
+	parts[len(parts)-1] = strings.TrimPrefix(parts[len(parts)-1], "x")
+
+	path := "tile/data/" + strings.Join(parts, "/")
+	if width < tileWidth {
+		path += ".p/" + strconv.FormatInt(width, 10)
+	}
+
+	return path
+}
+
+// tileLeaf is one entry of a data tile
+type tileLeaf struct {
+	updateType   string
+	timestamp    time.Time
+	leafDER      []byte
+	fingerprints [][]byte
+}
+
+// Fetch a data tile and split it into entries
+func (p *tiledPoller) fetchDataTile(tl tiledLog, tile int64, width int64) ([]tileLeaf, error) {
+	data, err := p.fetch(tl, dataTilePath(tile, width))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []tileLeaf
+	for len(data) > 0 && int64(len(entries)) < width {
+		var entry tileLeaf
+		if entry, data, err = readTileLeaf(data); err != nil {
+			return nil, fmt.Errorf("%s tile %d: %v", tl.url, tile, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Decode one TileLeaf, returning it and the remainder of the tile
+func readTileLeaf(data []byte) (tileLeaf, []byte, error) {
+	var entry tileLeaf
+
+	// timestamp, entry_type
+	if len(data) < 10 {
+		return entry, nil, fmt.Errorf("truncated tile")
+	}
+	entry.timestamp = time.UnixMilli(int64(binary.BigEndian.Uint64(data[:8])))
+	entryType := binary.BigEndian.Uint16(data[8:10])
+	data = data[10:]
+
+	var err error
+	switch entryType {
+	case ctX509Entry:
+		entry.updateType = "X509LogEntry"
+		if entry.leafDER, data, err = readOpaque24(data); err != nil {
+			return entry, nil, err
+		}
+	case ctPrecertEntry:
+		entry.updateType = "PrecertLogEntry"
+
+		// issuer_key_hash, then the TBSCertificate we don't need
+		if len(data) < 32 {
+			return entry, nil, fmt.Errorf("truncated tile")
+		}
+		if _, data, err = readOpaque24(data[32:]); err != nil {
+			return entry, nil, err
+		}
+	default:
+		return entry, nil, fmt.Errorf("unknown entry type %d", entryType)
+	}
+
+	// CtExtensions
+	if data, err = skipOpaque16(data); err != nil {
+		return entry, nil, err
+	}
+
+	// precerts carry the full pre_certificate after the TimestampedEntry
+	if entryType == ctPrecertEntry {
+		if entry.leafDER, data, err = readOpaque24(data); err != nil {
+			return entry, nil, err
+		}
+	}
+
+	// chain fingerprints
+	if len(data) < 2 {
+		return entry, nil, fmt.Errorf("truncated tile")
+	}
+	length := int(binary.BigEndian.Uint16(data[:2]))
+	if len(data) < 2+length || length%sha256.Size != 0 {
+		return entry, nil, fmt.Errorf("truncated tile")
+	}
+	for i := 2; i < 2+length; i += sha256.Size {
+		entry.fingerprints = append(entry.fingerprints, data[i:i+sha256.Size])
+	}
+
+	return entry, data[2+length:], nil
+}
+
+// Skip a 16 bit length prefixed value
+func skipOpaque16(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("truncated tile")
+	}
+
+	length := int(binary.BigEndian.Uint16(data[:2]))
+	if len(data) < 2+length {
+		return nil, fmt.Errorf("truncated tile")
+	}
+
+	return data[2+length:], nil
+}
+
+// fetchError is an issuer that couldn't be fetched, worth retrying unlike a
+// certificate that won't parse
+type fetchError struct {
+	err error
+}
+
+func (e fetchError) Error() string {
+	return e.err.Error()
+}
+
+// Parse the leaf, look up its issuers and wrap it as a certstream message
+func (p *tiledPoller) buildMessage(tl tiledLog, index int64, link string, entry tileLeaf) (*certstreamMessage, error) {
+	leaf, err := x509.ParseCertificate(entry.leafDER)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*x509.Certificate
+	for _, fingerprint := range entry.fingerprints {
+		issuer, err := p.issuer(tl, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, issuer)
+	}
+
+	return wrapCertificates(entry.updateType, entry.timestamp, leaf, chain, index, link, tl.url, tl.name), nil
+}
+
+// Fetch an issuer by SHA-256 fingerprint, caching it as issuers repeat
+func (p *tiledPoller) issuer(tl tiledLog, fingerprint []byte) (*x509.Certificate, error) {
+	key := hex.EncodeToString(fingerprint)
+
+	p.mu.Lock()
+	cert, ok := p.issuers[key]
+	p.mu.Unlock()
+
+	if ok {
+		return cert, nil
+	}
+
+	der, err := p.fetch(tl, "issuer/"+key)
+	if err != nil {
+		return nil, fetchError{err}
+	}
+
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.issuers[key] = cert
+	p.mu.Unlock()
+
+	return cert, nil
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCheckpoint signs a checkpoint note for origin the way Sunlight does,
+// with an RFC6962NoteSignature for ECDSA keys or a plain note signature for
+// Ed25519, and returns the note and the base64 DER public key
+func testCheckpoint(t *testing.T, signer crypto.Signer, origin string, size int64) (string, string) {
+	t.Helper()
+
+	rootHash := sha256.Sum256([]byte(fmt.Sprintf("root %d", size)))
+	text := fmt.Sprintf("%s\n%d\n%s\n", origin, size, base64.StdEncoding.EncodeToString(rootHash[:]))
+
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sig []byte
+	switch key := signer.(type) {
+	case ed25519.PrivateKey:
+		sig = append(testKeyID(origin, noteSigEd25519, key.Public().(ed25519.PublicKey)), ed25519.Sign(key, []byte(text))...)
+	case *ecdsa.PrivateKey:
+		timestamp := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixMilli()))
+
+		signed := []byte{0, 1}
+		signed = append(signed, timestamp...)
+		signed = binary.BigEndian.AppendUint64(signed, uint64(size))
+		signed = append(signed, rootHash[:]...)
+		digest := sha256.Sum256(signed)
+
+		signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the log ID, not the key, goes into the key ID
+		logID := sha256.Sum256(der)
+		sig = testKeyID(origin, noteSigRFC6962, logID[:])
+		sig = append(sig, timestamp...)
+		sig = append(sig, 4, 3) // SHA-256, ECDSA
+		sig = binary.BigEndian.AppendUint16(sig, uint16(len(signature)))
+		sig = append(sig, signature...)
+	default:
+		t.Fatalf("unsupported key %T", signer)
+	}
+
+	note := text + "\n— " + origin + " " + base64.StdEncoding.EncodeToString(sig) + "\n"
+	return note, base64.StdEncoding.EncodeToString(der)
+}
+
+// Computed independently of noteKeyID so the test checks the spec
+func testKeyID(name string, sigType byte, key []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte(name+"\n"), sigType), key...))
+	return hash[:4]
+}
+
+func TestVerifyCheckpoint(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const origin = "log.example.com/2026h1"
+
+	ecNote, ecPub := testCheckpoint(t, ecKey, origin, 1234)
+	edNote, edPub := testCheckpoint(t, edKey, origin, 1234)
+	_, otherPub := testCheckpoint(t, otherKey, origin, 1234)
+
+	tests := []struct {
+		name  string
+		note  string
+		key   string
+		valid bool
+	}{
+		{"ecdsa", ecNote, ecPub, true},
+		{"ed25519", edNote, edPub, true},
+		{"wrong key", ecNote, otherPub, false},
+		{"tampered size", strings.Replace(ecNote, "\n1234\n", "\n1235\n", 1), ecPub, false},
+		{"other origin", strings.Replace(ecNote, "— "+origin, "— other.example.com", 1), ecPub, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tl, err := newTiledLog("", "https://"+origin, test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			split := strings.Index(test.note, "\n\n")
+			text, signatures := test.note[:split+1], test.note[split+2:]
+			lines := strings.Split(text, "\n")
+			treeSize, _ := strconv.ParseInt(lines[1], 10, 64)
+			rootHash, _ := base64.StdEncoding.DecodeString(lines[2])
+
+			err = verifyCheckpoint(tl, lines[0], []byte(text), signatures, treeSize, rootHash)
+			if test.valid && err != nil {
+				t.Errorf("verifyCheckpoint: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("verifyCheckpoint accepted a bad signature")
+			}
+		})
+	}
+}
+
+// when the test log added entry 0, each later entry a second after
+var testTileLogged = time.Date(2020, 3, 27, 9, 49, 0, 123e6, time.UTC)
+
+// A TileLeaf for a certificate the log added at logged, its chain given by
+// fingerprint
+func testTileLeaf(leafDER []byte, issuerDER []byte, precert bool, logged time.Time) []byte {
+	leaf := binary.BigEndian.AppendUint64(nil, uint64(logged.UnixMilli()))
+
+	if precert {
+		leaf = binary.BigEndian.AppendUint16(leaf, ctPrecertEntry)
+		leaf = append(leaf, make([]byte, 32)...)
+		leaf = append(leaf, opaque24([]byte("tbs"))...)
+		leaf = append(leaf, 0, 0)
+		leaf = append(leaf, opaque24(leafDER)...)
+	} else {
+		leaf = binary.BigEndian.AppendUint16(leaf, ctX509Entry)
+		leaf = append(leaf, opaque24(leafDER)...)
+		leaf = append(leaf, 0, 0)
+	}
+
+	fingerprint := sha256.Sum256(issuerDER)
+	leaf = binary.BigEndian.AppendUint16(leaf, sha256.Size)
+	return append(leaf, fingerprint[:]...)
+}
+
+// Lay out a tiled log in dir with a partial first tile of three entries,
+// the middle one a precert, and a checkpoint signed by signer. Returns the
+// base64 public key.
+func writeTestTiledLog(t *testing.T, dir string, signer crypto.Signer, origin string) string {
+	t.Helper()
+
+	ca := newTestCA(t)
+
+	var tile []byte
+	for i, name := range []string{"zero.example.com", "one.example.com", "two.example.com"} {
+		tile = append(tile, testTileLeaf(ca.issue(t, name, int64(100+i), i == 1), ca.cert.Raw, i == 1, testTileLogged.Add(time.Duration(i)*time.Second))...)
+	}
+
+	note, key := testCheckpoint(t, signer, origin, 3)
+	fingerprint := sha256.Sum256(ca.cert.Raw)
+
+	files := map[string][]byte{
+		"checkpoint":       []byte(note),
+		dataTilePath(0, 3): tile,
+		"issuer/" + hex.EncodeToString(fingerprint[:]): ca.cert.Raw,
+	}
+	for path, data := range files {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return key
+}
+
+// Check the messages are entries from, in order, with the precert at 1
+func checkTiledMessages(t *testing.T, messages []*certstreamMessage, from int64) {
+	t.Helper()
+
+	names := []string{"zero.example.com", "one.example.com", "two.example.com"}
+	for i, message := range messages {
+		index := from + int64(i)
+
+		name, issuer := message.Data.LeafCert.Subject.CN, message.Data.Chain[0].Subject.CN
+		if message.Data.CertIndex != index || name != names[index] || issuer != "Test Issuing CA" {
+			t.Errorf("message %d is entry %d for %q from %q, want entry %d for %q", i, message.Data.CertIndex, name, issuer, index, names[index])
+		}
+		if precert := message.Data.UpdateType == "PrecertLogEntry"; precert != (index == 1) {
+			t.Errorf("entry %d has update type %s", index, message.Data.UpdateType)
+		}
+		if want := testTileLogged.Add(time.Duration(index) * time.Second); message.seen().Sub(want).Abs() > time.Microsecond {
+			t.Errorf("entry %d seen %s, want the log's timestamp %s", index, message.seen().UTC(), want)
+		}
+	}
+}
+
+// Wait for the saved checkpoint to reach next
+func waitForCheckpoint(t *testing.T, checkpoint *ctCheckpoint, url string, next int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got, _ := checkpoint.get(url); got == next {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("checkpoint at %d, want %d", got, next)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTiledLogStreamFromDirectory(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	pub := writeTestTiledLog(t, dir, key, "log.example.com/2026h1")
+
+	tl, err := parseTiledLog("test", dir+","+pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resume after the first entry
+	checkpoint, err := loadCTCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkpoint.set(tl.url, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, errStream := tiledLogStream([]tiledLog{tl}, checkpoint, time.Hour)
+	checkTiledMessages(t, receiveMessages(t, stream, errStream, 2), 1)
+	waitForCheckpoint(t, checkpoint, tl.url, 3)
+}
+
+func TestTiledLogStreamOverHTTP(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	pub := writeTestTiledLog(t, dir, key, "log.example.com/2026h1")
+
+	// the first issuer fetch fails, which must not lose the entry
+	var issuerFailures atomic.Int32
+	files := http.FileServer(http.Dir(dir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/issuer/") && issuerFailures.Add(1) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	tl, err := newTiledLog("", server.URL, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err := loadCTCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkpoint.set(tl.url, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, errStream := tiledLogStream([]tiledLog{tl}, checkpoint, 10*time.Millisecond)
+
+	select {
+	case err := <-errStream:
+		if !strings.Contains(err.Error(), "503") {
+			t.Errorf("first error %q, want the failed issuer fetch", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error for the failed issuer fetch")
+	}
+	if next, _ := checkpoint.get(tl.url); next != 0 {
+		t.Errorf("checkpoint moved to %d past an entry that wasn't sent", next)
+	}
+
+	checkTiledMessages(t, receiveMessages(t, stream, errStream, 3), 0)
+	waitForCheckpoint(t, checkpoint, tl.url, 3)
+}
+
+func TestTiledLogStreamRejectsBadSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writeTestTiledLog(t, dir, key, "log.example.com/2026h1")
+	_, otherPub := testCheckpoint(t, otherKey, "log.example.com/2026h1", 3)
+
+	tl, err := newTiledLog("", dir, otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err := loadCTCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkpoint.set(tl.url, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, errStream := tiledLogStream([]tiledLog{tl}, checkpoint, time.Hour)
+
+	select {
+	case message := <-stream:
+		t.Errorf("got entry %d from an unverified checkpoint", message.Data.CertIndex)
+	case err := <-errStream:
+		if !strings.Contains(err.Error(), "no valid checkpoint signature") {
+			t.Errorf("error %q, want a signature failure", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error for the bad signature")
+	}
+}
+
+func TestDataTilePath(t *testing.T) {
+	tests := []struct {
+		tile  int64
+		width int64
+		path  string
+	}{
+		{0, 256, "tile/data/000"},
+		{0, 3, "tile/data/000.p/3"},
+		{67, 256, "tile/data/067"},
+		{1234067, 256, "tile/data/x001/x234/067"},
+		{1234067, 10, "tile/data/x001/x234/067.p/10"},
+	}
+
+	for _, test := range tests {
+		if path := dataTilePath(test.tile, test.width); path != test.path {
+			t.Errorf("dataTilePath(%d, %d) = %q, want %q", test.tile, test.width, path, test.path)
+		}
+	}
+}
+
+func TestReadTileLeafTruncated(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := testTileLeaf(ca.issue(t, "example.com", 1, false), ca.cert.Raw, false, testTileLogged)
+
+	if _, rest, err := readTileLeaf(leaf); err != nil || len(rest) != 0 {
+		t.Fatalf("readTileLeaf = %d left, %v", len(rest), err)
+	}
+
+	for _, cut := range []int{5, 12, len(leaf) - 40, len(leaf) - 1} {
+		if _, _, err := readTileLeaf(leaf[:cut]); err == nil {
+			t.Errorf("readTileLeaf of %d of %d bytes succeeded", cut, len(leaf))
+		}
+	}
+
+	if _, _, err := readTileLeaf(bytes.Repeat([]byte{0xff}, 20)); err == nil {
+		t.Errorf("readTileLeaf of an unknown entry type succeeded")
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// built in -webhook-template bodies. "json" is the records themselves,
+// "text" a message Slack, Mattermost and Teams incoming webhooks all accept.
+var webhookTemplates = map[string]string{
+	"json": `{"count": {{.Count}}, "matches": {{json .Matches}}}`,
+	"text": `{"text": {{json (summary .Matches)}}}`,
+}
+
+// helpers for webhook templates, json to quote any value
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+	"join":    strings.Join,
+	"summary": webhookSummary,
+}
+
+// webhookPayload is what a template is executed with
+type webhookPayload struct {
+	Count   int
+	Matches []matchRecord
+}
+
+// webhookOptions configure a webhookSink
+type webhookOptions struct {
+	template  string
+	secret    string
+	batch     time.Duration
+	retries   int
+	backoff   time.Duration
+	queueDir  string
+	queueSize int
+	timeout   time.Duration
+}
+
+// webhookSink POSTs matches to each URL, one at a time or batched, through
+// a queue per URL that's kept on disk if queueDir is set
+type webhookSink struct {
+	options  webhookOptions
+	template *template.Template
+	queues   []*webhookQueue
+
+	mu      sync.Mutex
+	pending []matchRecord
+}
+
+// webhookQueue holds the bodies waiting to be sent to one URL, oldest
+// first, each in its own file if the queue is on disk
+type webhookQueue struct {
+	url     string
+	dir     string
+	limit   int
+	mu      sync.Mutex
+	bodies  []queuedBody
+	wake    chan struct{}
+	sending bool
+	seq     int
+}
+
+type queuedBody struct {
+	id   int
+	file string
+	body []byte
+}
+
+// Start a sink sending to urls, loading anything queued by an earlier run
+func newWebhookSink(urls []string, options webhookOptions) (*webhookSink, error) {
+	if options.queueSize < 1 {
+		return nil, fmt.Errorf("queue size must be at least 1, not %d", options.queueSize)
+	}
+
+	text, ok := webhookTemplates[options.template]
+	if !ok {
+		body, err := os.ReadFile(options.template)
+		if err != nil {
+			return nil, fmt.Errorf("template %q is neither json, text nor a readable file: %v", options.template, err)
+		}
+		text = string(body)
+	}
+
+	tmpl, err := template.New("webhook").Funcs(webhookFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &webhookSink{options: options, template: tmpl}
+
+	for _, url := range urls {
+		queue := &webhookQueue{url: url, limit: options.queueSize, wake: make(chan struct{}, 1)}
+
+		if options.queueDir != "" {
+			// a directory per URL, so a changed list doesn't send old bodies to the wrong place
+			sum := sha256.Sum256([]byte(url))
+			queue.dir = filepath.Join(options.queueDir, hex.EncodeToString(sum[:8]))
+
+			if err := queue.load(); err != nil {
+				return nil, err
+			}
+			if len(queue.bodies) > 0 {
+				log.Printf("Webhook %q has %d queued from an earlier run", url, len(queue.bodies))
+			}
+		}
+
+		sink.queues = append(sink.queues, queue)
+		go sink.send(queue)
+	}
+
+	if options.batch > 0 {
+		go func() {
+			for range time.Tick(options.batch) {
+				sink.flush()
+			}
+		}()
+	}
+
+	return sink, nil
+}
+
+// Alert on a match, now or in the next batch
+func (s *webhookSink) add(record matchRecord) {
+	s.mu.Lock()
+	s.pending = append(s.pending, record)
+	s.mu.Unlock()
+
+	if s.options.batch == 0 {
+		s.flush()
+	}
+}
+
+// Render the pending matches and queue them for every URL
+func (s *webhookSink) flush() {
+	s.mu.Lock()
+	matches := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(matches) == 0 {
+		return
+	}
+
+	var body bytes.Buffer
+	if err := s.template.Execute(&body, webhookPayload{Count: len(matches), Matches: matches}); err != nil {
+		log.Printf("Error rendering webhook template: %q", err)
+		return
+	}
+
+	for _, queue := range s.queues {
+		if err := queue.push(body.Bytes()); err != nil {
+			log.Printf("Error queueing webhook for %q: %q", queue.url, err)
+		}
+	}
+}
+
+// Send the last batch and wait up to timeout for the queues to empty.
+// Whatever's left stays on disk for the next run.
+func (s *webhookSink) Close(timeout time.Duration) {
+	s.flush()
+
+	deadline := time.Now().Add(timeout)
+	for _, queue := range s.queues {
+		for queue.busy() && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if left := queue.len(); left > 0 {
+			log.Printf("Webhook %q still has %d queued", queue.url, left)
+		}
+	}
+}
+
+// Deliver a queue's bodies in order, retrying each with exponential
+// backoff, dropping it after the retries or on a client error
+func (s *webhookSink) send(queue *webhookQueue) {
+	client := &http.Client{Timeout: s.options.timeout}
+
+	for {
+		queued, ok := queue.head()
+		if !ok {
+			<-queue.wake
+			continue
+		}
+
+		backoff := s.options.backoff
+		for attempt := 0; ; attempt++ {
+			err := s.post(client, queue.url, queued.body)
+			if err == nil {
+				break
+			}
+
+			var rejected *webhookError
+			if errors.As(err, &rejected) && rejected.permanent() {
+				log.Printf("Webhook %q rejected a body, dropping it: %q", queue.url, err)
+				break
+			}
+			if attempt >= s.options.retries {
+				log.Printf("Webhook %q failed %d times, dropping a body: %q", queue.url, attempt+1, err)
+				break
+			}
+
+			log.Printf("Webhook %q failed, retrying in %s: %q", queue.url, backoff, err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, 5*time.Minute)
+		}
+
+		queue.pop(queued.id)
+	}
+}
+
+// webhookError is a response other than 2xx
+type webhookError struct {
+	status int
+}
+
+func (e *webhookError) Error() string {
+	return fmt.Sprintf("HTTP %d %s", e.status, http.StatusText(e.status))
+}
+
+// Client errors won't succeed on a retry, other than a timeout or rate limit
+func (e *webhookError) permanent() bool {
+	return e.status >= 400 && e.status < 500 && e.status != http.StatusRequestTimeout && e.status != http.StatusTooManyRequests
+}
+
+// POST a body, signed if there's a secret. The signature is the hex HMAC
+// SHA-256 of the timestamp header, a dot and the body, so a receiver can
+// reject replays.
+func (s *webhookSink) post(client *http.Client, url string, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	if s.options.secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set("X-Certificates-Timestamp", timestamp)
+		request.Header.Set("X-Certificates-Signature", "sha256="+signWebhook(s.options.secret, timestamp, body))
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &webhookError{response.StatusCode}
+	}
+	return nil
+}
+
+// Hex HMAC SHA-256 of timestamp.body
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// One line per match, for chat
+func webhookSummary(matches []matchRecord) string {
+	var lines []string
+	for _, match := range matches {
+		line := fmt.Sprintf("Certificate for %s matched %q: %s, %s, issued by %s, fingerprint %s", match.MatchedDomain, match.MatchedPattern, match.Level, match.UpdateType, match.IssuingCA, match.Fingerprint)
+		if match.Lookalike != "" {
+			line += fmt.Sprintf(", lookalike of %s by %s, score %.2f", match.Lookalike, match.LookalikeTechnique, match.LookalikeScore)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Read the bodies left in the queue directory, oldest first
+func (q *webhookQueue) load() error {
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return err
+	}
+
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		body, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		q.seq++
+		q.bodies = append(q.bodies, queuedBody{q.seq, file, body})
+	}
+
+	// the newest over the limit are kept
+	for len(q.bodies) > q.limit {
+		q.drop()
+	}
+
+	return nil
+}
+
+// Add a body, dropping the oldest if the queue is full
+func (q *webhookQueue) push(body []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	queued := queuedBody{id: q.seq, body: body}
+	if q.dir != "" {
+		// names sort in the order they were queued
+		queued.file = filepath.Join(q.dir, fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), q.seq%1000000))
+		if err := os.WriteFile(queued.file, body, 0644); err != nil {
+			return err
+		}
+	}
+
+	q.bodies = append(q.bodies, queued)
+	for len(q.bodies) > q.limit {
+		log.Printf("Webhook queue for %q is full, dropping the oldest", q.url)
+		q.drop()
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// The oldest body, marking the queue as sending it
+func (q *webhookQueue) head() (queuedBody, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.bodies) == 0 {
+		q.sending = false
+		return queuedBody{}, false
+	}
+
+	q.sending = true
+	return q.bodies[0], true
+}
+
+// Remove the body just sent, unless it was dropped while sending
+func (q *webhookQueue) pop(id int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.bodies) > 0 && q.bodies[0].id == id {
+		q.drop()
+	}
+}
+
+// Remove the oldest body, holding the lock
+func (q *webhookQueue) drop() {
+	if file := q.bodies[0].file; file != "" {
+		if err := os.Remove(file); err != nil {
+			log.Printf("Error removing queued webhook: %q", err)
+		}
+	}
+	q.bodies = q.bodies[1:]
+}
+
+func (q *webhookQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.bodies)
+}
+
+// Whether anything's waiting or being sent
+func (q *webhookQueue) busy() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.bodies) > 0 || q.sending
+}
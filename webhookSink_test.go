@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a request a test receiver got, and when
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// testReceiver answers with each status in turn, then 200, passing every
+// request on to received
+type testReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	received chan webhookRequest
+}
+
+func newTestReceiver(t *testing.T, statuses ...int) (*testReceiver, *httptest.Server) {
+	receiver := &testReceiver{statuses: statuses, received: make(chan webhookRequest, 100)}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request := webhookRequest{r.Header.Clone(), body, time.Now()}
+
+		receiver.mu.Lock()
+		status := http.StatusOK
+		if len(receiver.statuses) > 0 {
+			status, receiver.statuses = receiver.statuses[0], receiver.statuses[1:]
+		}
+		receiver.mu.Unlock()
+
+		w.WriteHeader(status)
+		receiver.received <- request
+	}))
+	t.Cleanup(server.Close)
+
+	return receiver, server
+}
+
+// Wait for the next request
+func (r *testReceiver) next(t *testing.T) webhookRequest {
+	t.Helper()
+
+	select {
+	case request := <-r.received:
+		return request
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook received")
+	}
+	return webhookRequest{}
+}
+
+// Wait briefly, failing if another request arrives
+func (r *testReceiver) none(t *testing.T) {
+	t.Helper()
+
+	select {
+	case request := <-r.received:
+		t.Errorf("unexpected webhook %s", request.body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func testWebhookOptions() webhookOptions {
+	return webhookOptions{
+		template:  "json",
+		retries:   3,
+		backoff:   20 * time.Millisecond,
+		queueSize: 10,
+		timeout:   time.Second,
+	}
+}
+
+func testMatchRecord(name string) matchRecord {
+	record := matchRecord{Log: "test"}
+	record.CommonName = name
+	record.MatchedDomain = name
+	record.Fingerprint = "AA:BB"
+	return record
+}
+
+// The common names in a json template body
+func webhookNames(t *testing.T, body []byte) []string {
+	t.Helper()
+
+	var payload struct {
+		Count   int `json:"count"`
+		Matches []struct {
+			CommonName string `json:"common_name"`
+		} `json:"matches"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("body %s: %v", body, err)
+	}
+
+	var names []string
+	for _, match := range payload.Matches {
+		names = append(names, match.CommonName)
+	}
+	if payload.Count != len(names) {
+		t.Errorf("count %d for %d matches", payload.Count, len(names))
+	}
+	return names
+}
+
+func TestWebhookSigning(t *testing.T) {
+	receiver, server := newTestReceiver(t)
+
+	options := testWebhookOptions()
+	options.secret = "s3cret"
+	sink, err := newWebhookSink([]string{server.URL}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink.add(testMatchRecord("paypal-login.com"))
+	request := receiver.next(t)
+
+	timestamp := request.header.Get("X-Certificates-Timestamp")
+	if timestamp == "" {
+		t.Fatal("no timestamp header")
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + string(request.body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := request.header.Get("X-Certificates-Signature"); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if names := webhookNames(t, request.body); len(names) != 1 || names[0] != "paypal-login.com" {
+		t.Errorf("matches %q", names)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+	}{
+		{"server errors then success", []int{503, 500}, 3},
+		{"rate limited then success", []int{429}, 2},
+		{"client error dropped", []int{400}, 1},
+		{"gone dropped", []int{410}, 1},
+		{"retries exhausted", []int{503, 503, 503, 503}, 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			receiver, server := newTestReceiver(t, test.statuses...)
+
+			options := testWebhookOptions()
+			sink, err := newWebhookSink([]string{server.URL}, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sink.add(testMatchRecord("first.example.com"))
+
+			var requests []webhookRequest
+			for i := 0; i < test.attempts; i++ {
+				requests = append(requests, receiver.next(t))
+			}
+
+			// the backoff doubles between attempts
+			for i := 1; i < len(requests); i++ {
+				gap := requests[i].at.Sub(requests[i-1].at)
+				if want := options.backoff << (i - 1); gap < want {
+					t.Errorf("attempt %d came %s after the last, want at least %s", i+1, gap, want)
+				}
+			}
+
+			// then the queue moves on, whether it was sent or dropped
+			sink.add(testMatchRecord("second.example.com"))
+			if names := webhookNames(t, receiver.next(t).body); len(names) != 1 || names[0] != "second.example.com" {
+				t.Errorf("next webhook has %q, want the second match", names)
+			}
+			receiver.none(t)
+		})
+	}
+}
+
+func TestWebhookBatch(t *testing.T) {
+	receiver, server := newTestReceiver(t)
+
+	options := testWebhookOptions()
+	options.batch = 100 * time.Millisecond
+	sink, err := newWebhookSink([]string{server.URL}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink.add(testMatchRecord("one.example.com"))
+	sink.add(testMatchRecord("two.example.com"))
+
+	if names := webhookNames(t, receiver.next(t).body); len(names) != 2 {
+		t.Errorf("batch has %q, want both matches", names)
+	}
+}
+
+func TestWebhookQueueReload(t *testing.T) {
+	dir := t.TempDir()
+
+	// a receiver that's down, and a backoff long enough the body stays queued
+	receiver, server := newTestReceiver(t, http.StatusServiceUnavailable)
+	options := testWebhookOptions()
+	options.queueDir = dir
+	options.backoff = time.Hour
+
+	sink, err := newWebhookSink([]string{server.URL}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.add(testMatchRecord("queued.example.com"))
+	receiver.next(t)
+
+	queued, _ := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if len(queued) != 1 {
+		t.Fatalf("%d bodies on disk, want 1", len(queued))
+	}
+
+	// a later run sends it once the receiver is back, then removes it
+	options.backoff = 20 * time.Millisecond
+	if _, err := newWebhookSink([]string{server.URL}, options); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := webhookNames(t, receiver.next(t).body); len(names) != 1 || names[0] != "queued.example.com" {
+		t.Errorf("reloaded webhook has %q", names)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		left, _ := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+		if len(left) == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("%d bodies still on disk after sending", len(left))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookQueueDropsOldest(t *testing.T) {
+	queue := &webhookQueue{url: "http://example.com", limit: 2, wake: make(chan struct{}, 1)}
+
+	for _, body := range []string{"a", "b", "c"} {
+		if err := queue.push([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if head, _ := queue.head(); queue.len() != 2 || string(head.body) != "b" {
+		t.Errorf("queue holds %d starting %q, want 2 starting b", queue.len(), head.body)
+	}
+}
+
+func TestNewWebhookSinkRejectsQueueSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		options := testWebhookOptions()
+		options.queueSize = size
+		if _, err := newWebhookSink([]string{"http://example.com"}, options); err == nil {
+			t.Errorf("queue size %d accepted", size)
+		}
+	}
+}
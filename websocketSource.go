@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// the public CaliDog certstream server
+const defaultStreamURL = "wss://certstream.calidog.io/"
+
+// how long a connection can be silent before we give up on it
+const streamReadTimeout = 2 * time.Minute
+
+// streamOptions configures the connection to a certstream server
+type streamOptions struct {
+	url        string
+	headers    http.Header
+	caBundle   string
+	proxy      string
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// longest gap between heartbeats before the stream counts as stalled
+	heartbeat time.Duration
+}
+
+// websocketStream connects to a certstream server, such as a self-hosted
+// certstream-server, and feeds its messages down the same channels as the
+// library stream. Heartbeats are passed through, and once one has arrived a
+// gap of longer than opts.heartbeat is treated as a stall. Stalled and
+// dropped connections are retried with exponential backoff and jitter, and
+// each change in connection state is logged.
+func websocketStream(opts streamOptions) (chan *certstreamMessage, chan error, error) {
+	dialer, err := newStreamDialer(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream := make(chan *certstreamMessage)
+	errStream := make(chan error)
+
+	go func() {
+		backoff := opts.minBackoff
+		attempt := 0
+
+		for {
+			attempt++
+			log.Printf("Connecting to %q (attempt %d)", opts.url, attempt)
+
+			connected, err := readStream(dialer, opts, stream, errStream)
+
+			// a connection that worked resets the backoff
+			if connected > 0 {
+				backoff = opts.minBackoff
+				attempt = 0
+				log.Printf("Disconnected from %q after %s", opts.url, connected.Round(time.Second))
+			}
+
+			errStream <- err
+
+			wait := jitter(backoff)
+			log.Printf("Reconnecting to %q in %s", opts.url, wait.Round(time.Millisecond))
+			time.Sleep(wait)
+
+			backoff *= 2
+			if backoff > opts.maxBackoff {
+				backoff = opts.maxBackoff
+			}
+		}
+	}()
+
+	return stream, errStream, nil
+}
+
+// Set up TLS and proxy settings for the connection
+func newStreamDialer(opts streamOptions) (*websocket.Dialer, error) {
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 30 * time.Second,
+	}
+
+	if opts.proxy != "" {
+		proxyURL, err := url.Parse(opts.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy URL: %v", err)
+		}
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if opts.caBundle != "" {
+		pem, err := os.ReadFile(opts.caBundle)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", opts.caBundle)
+		}
+		dialer.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return dialer, nil
+}
+
+// Dial and read messages until the connection fails, returning how long it
+// was up and why it ended
+func readStream(dialer *websocket.Dialer, opts streamOptions, stream chan *certstreamMessage, errStream chan error) (time.Duration, error) {
+	conn, response, err := dialer.Dial(opts.url, opts.headers)
+	if err != nil {
+		if response != nil {
+			return 0, fmt.Errorf("connecting to %q: %v (HTTP %s)", opts.url, err, response.Status)
+		}
+		return 0, fmt.Errorf("connecting to %q: %v", opts.url, err)
+	}
+	defer conn.Close()
+
+	log.Printf("Connected to %q", opts.url)
+	connectedAt := time.Now()
+
+	// not every server sends heartbeats, so only watch for them once one arrives
+	var lastHeartbeat time.Time
+	stalled := func() error {
+		if opts.heartbeat <= 0 || lastHeartbeat.IsZero() || time.Since(lastHeartbeat) < opts.heartbeat {
+			return nil
+		}
+
+		silence := time.Since(lastHeartbeat).Round(100 * time.Millisecond)
+		log.Printf("ALERT: no heartbeat from %q for %s, reconnecting", opts.url, silence)
+		return fmt.Errorf("stalled: no heartbeat from %q for %s", opts.url, silence)
+	}
+
+	for {
+		deadline := time.Now().Add(streamReadTimeout)
+		if opts.heartbeat > 0 && !lastHeartbeat.IsZero() && lastHeartbeat.Add(opts.heartbeat).Before(deadline) {
+			deadline = lastHeartbeat.Add(opts.heartbeat)
+		}
+		conn.SetReadDeadline(deadline)
+
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if stallErr := stalled(); stallErr != nil {
+				return time.Since(connectedAt), stallErr
+			}
+			return time.Since(connectedAt), fmt.Errorf("reading from %q: %v", opts.url, err)
+		}
+
+		// a bad message is reported, but the connection is still good
+		message, err := decodeMessage(data)
+		if err != nil {
+			errStream <- fmt.Errorf("decoding from %q: %w", opts.url, err)
+			continue
+		}
+
+		// certificates can keep flowing without heartbeats if the server is wedged
+		if message.MessageType == typeHeartbeat {
+			lastHeartbeat = time.Now()
+		} else if stallErr := stalled(); stallErr != nil {
+			return time.Since(connectedAt), stallErr
+		}
+
+		stream <- message
+	}
+}
+
+// Spread reconnects by up to half the backoff either way
+func jitter(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// Parse "Name: value" header flags, adding a bearer token if given
+func parseStreamHeaders(values []string, token string) (http.Header, error) {
+	headers := http.Header{}
+
+	for _, value := range values {
+		i := strings.Index(value, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("bad header %q, use \"Name: value\"", value)
+		}
+		headers.Add(strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:]))
+	}
+
+	if token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+
+	return headers, nil
+}